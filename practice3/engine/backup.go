@@ -0,0 +1,430 @@
+package engine
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/tidwall/rtree"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"practice3/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backup is a tar archive of the checkpoint, its deltas, the log segments
+// and the segment manifest, followed by backup.json with the vclock and the
+// SHA-256 of every file. The files are named independently of the node, so a
+// backup can be loaded into a node with another name.
+
+const (
+	backupManifest = "backup.json"
+	backupSegments = "segments.json"
+	backupChkFile  = "checkpoint.json"
+	backupLogFile  = "transaction.log"
+)
+
+var (
+	ErrNotEmpty      = errors.New("node is not empty")
+	ErrInvalidBackup = errors.New("invalid backup")
+)
+
+// BackupManifest describes the node and the files of a backup.
+type BackupManifest struct {
+	Name    string            `json:"name"`
+	VClock  map[string]uint64 `json:"vclock"`
+	Created time.Time         `json:"created"`
+	Files   []BackupFile      `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type backupEntry struct {
+	name string
+	r    io.Reader
+	size int64
+}
+
+// Backup writes a backup to w. The files are opened while the Engine is
+// locked and read afterwards, so writes go on meanwhile. Files replaced or
+// removed by a checkpoint stay readable through the open handles, and the
+// active segment is read up to its size at that time.
+func (e *Engine) Backup(w io.Writer) error {
+	e.Mu.Lock()
+	entries, files, err := e.backupEntries()
+	vclock := e.copyVClock()
+	e.Mu.Unlock()
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	m := BackupManifest{Name: e.name, VClock: vclock, Created: time.Now()}
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: entry.size, ModTime: m.Created}); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tw, hash), io.LimitReader(entry.r, entry.size))
+		if err != nil {
+			return err
+		}
+		if n != entry.size {
+			return fmt.Errorf("%s: %w", entry.name, io.ErrUnexpectedEOF)
+		}
+		m.Files = append(m.Files, BackupFile{Name: entry.name, Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0644, Size: int64(len(data)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// backupEntries opens the files of a backup. The caller closes the returned
+// files, also on error.
+func (e *Engine) backupEntries() ([]backupEntry, []*os.File, error) {
+	var entries []backupEntry
+	var files []*os.File
+	add := func(name string, filename string, size int64) (bool, error) {
+		file, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		files = append(files, file)
+
+		if size < 0 {
+			info, err := file.Stat()
+			if err != nil {
+				return false, err
+			}
+			size = info.Size()
+		}
+		entries = append(entries, backupEntry{name: name, r: file, size: size})
+		return true, nil
+	}
+
+	if _, err := add(backupChkFile, e.ChkFile, -1); err != nil {
+		return entries, files, err
+	}
+	for _, file := range e.deltaFiles() {
+		if _, err := add(backupChkFile+strings.TrimPrefix(file, e.ChkFile), file, -1); err != nil {
+			return entries, files, err
+		}
+	}
+
+	m := manifest{Seq: e.segmentSeq, Active: e.active}
+	m.Active.File = backupLogFile
+	for _, seg := range e.segments {
+		name := backupLogFile + strings.TrimPrefix(seg.File, e.active.File)
+		ok, err := add(name, seg.File, -1)
+		if err != nil {
+			return entries, files, err
+		}
+		if ok {
+			seg.File = name
+			m.Segments = append(m.Segments, seg)
+		}
+	}
+	if _, err := add(backupLogFile, e.active.File, e.logSize); err != nil {
+		return entries, files, err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return entries, files, err
+	}
+	entries = append(entries, backupEntry{name: backupSegments, r: strings.NewReader(string(data)), size: int64(len(data))})
+	return entries, files, nil
+}
+
+// VerifyBackup checks every file of a backup against its checksum and
+// decodes every record. It needs no node.
+func VerifyBackup(r io.Reader) (BackupManifest, error) {
+	return readBackup(r, func(name string, r io.Reader) error {
+		switch {
+		case name == backupSegments:
+			var m manifest
+			return json.NewDecoder(r).Decode(&m)
+		case strings.HasPrefix(name, backupChkFile):
+			return readCheckpointFrom(r, func(util.Transaction) error { return nil })
+		default:
+			_, err := readRecords(r, func(data []byte) error {
+				_, err := decode(data)
+				return err
+			})
+			return err
+		}
+	})
+}
+
+// RestoreBackup loads a backup into an empty Engine, then restores it to the
+// target if there is one. The backup is verified before any file is
+// replaced.
+func (e *Engine) RestoreBackup(r io.Reader, target *RecoveryTarget) error {
+	e.Mu.Lock()
+	logFile := e.active.File
+	e.Mu.Unlock()
+
+	dir, err := os.MkdirTemp(filepath.Dir(logFile), filepath.Base(logFile)+".backup.*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := readBackup(r, func(name string, r io.Reader) error {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(file, r); err != nil {
+			return err
+		}
+		return file.Sync()
+	})
+	if err != nil {
+		return err
+	}
+
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+	if !e.empty() {
+		return ErrNotEmpty
+	}
+	if err := e.installBackup(dir, m); err != nil {
+		return err
+	}
+	if target != nil {
+		return e.handleRestore(*target)
+	}
+	return nil
+}
+
+// empty reports whether nothing was ever written to the Engine.
+func (e *Engine) empty() bool {
+	for _, lsn := range e.vclock {
+		if lsn > 0 {
+			return false
+		}
+	}
+	return len(e.Data) == 0 && !e.checkpointing
+}
+
+// installBackup moves the files of a verified backup in place of the
+// Engine's files and loads them. The local files are moved aside into the
+// backup directory first, and if the backup cannot be installed or loaded
+// every rename is undone and the Engine keeps its own log.
+func (e *Engine) installBackup(dir string, m BackupManifest) error {
+	logFile := e.active.File
+	local := func(name string) string {
+		if strings.HasPrefix(name, backupChkFile) {
+			return e.ChkFile + strings.TrimPrefix(name, backupChkFile)
+		}
+		return logFile + strings.TrimPrefix(name, backupLogFile)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, backupSegments))
+	if err != nil {
+		return err
+	}
+	var segments manifest
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return err
+	}
+	for i := range segments.Segments {
+		segments.Segments[i].File = local(segments.Segments[i].File)
+	}
+	segments.Active.File = logFile
+
+	aside := filepath.Join(dir, "replaced")
+	if err := os.Mkdir(aside, 0755); err != nil {
+		return err
+	}
+	var moved [][2]string
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		moved = append(moved, [2]string{from, to})
+		return nil
+	}
+	undo := func(err error) error {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if err := os.Rename(moved[i][1], moved[i][0]); err != nil {
+				slog.Error("Failed to move back replaced file", "file", moved[i][0], "error", err)
+			}
+		}
+		return err
+	}
+
+	replaced := append([]string{e.ChkFile, logFile}, e.deltaFiles()...)
+	for _, seg := range e.segments {
+		replaced = append(replaced, seg.File)
+	}
+	for _, file := range m.Files {
+		if file.Name != backupSegments {
+			replaced = append(replaced, local(file.Name))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, file := range replaced {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		if err := move(file, filepath.Join(aside, strconv.Itoa(i))); err != nil && !os.IsNotExist(err) {
+			return undo(err)
+		}
+	}
+	for _, file := range m.Files {
+		if file.Name == backupSegments {
+			continue
+		}
+		if err := move(filepath.Join(dir, file.Name), local(file.Name)); err != nil {
+			return undo(err)
+		}
+	}
+	if err := saveManifest(logFile, segments); err != nil {
+		return undo(err)
+	}
+
+	// The Engine is empty, so its state is reset rather than saved, but its
+	// log and segments stay in use until the backup is loaded
+	transLog, seq, oldSegments, active, logSize := e.TransLog, e.segmentSeq, e.segments, e.active, e.logSize
+	reset := func() {
+		e.Data = make(map[string]*geojson.Feature)
+		e.versions = make(map[string]version)
+		e.rtreeIndex = rtree.RTreeG[*geojson.Feature]{}
+		e.vclock = make(map[string]uint64)
+		e.changed = make(map[string]bool)
+		e.hasBase = false
+		e.txTime = 0
+	}
+	reset()
+	err = e.loadCheckpoint(nil)
+	if err == nil {
+		e.chkVClock = e.copyVClock()
+		e.chkStatus.VClock = e.chkVClock
+		err = e.loadTransactionLog(logFile)
+	}
+	if err != nil {
+		if e.TransLog != transLog {
+			e.TransLog.Close()
+		}
+		reset()
+		e.TransLog, e.segmentSeq, e.segments, e.active, e.logSize = transLog, seq, oldSegments, active, logSize
+		e.chkVClock = e.copyVClock()
+		e.chkStatus.VClock = e.chkVClock
+		if err := e.saveManifest(); err != nil {
+			slog.Error("Failed to restore segment manifest", "error", err)
+		}
+		return undo(err)
+	}
+	transLog.Close()
+	return nil
+}
+
+// readBackup calls fn for every file of a backup and checks the files
+// against backup.json at its end. A backup cut off early has no backup.json.
+func readBackup(r io.Reader, fn func(name string, r io.Reader) error) (BackupManifest, error) {
+	var m BackupManifest
+	found := false
+	files := make(map[string]BackupFile)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if found {
+			return m, fmt.Errorf("%w: %s after %s", ErrInvalidBackup, header.Name, backupManifest)
+		}
+
+		if header.Name == backupManifest {
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, backupManifest, err)
+			}
+			found = true
+			continue
+		}
+		if !validBackupName(header.Name) {
+			return m, fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, header.Name)
+		}
+		if _, ok := files[header.Name]; ok {
+			return m, fmt.Errorf("%w: duplicate file %s", ErrInvalidBackup, header.Name)
+		}
+
+		hash := sha256.New()
+		reader := io.TeeReader(tr, hash)
+		if err := fn(header.Name, reader); err != nil {
+			return m, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, header.Name, err)
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return m, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, header.Name, err)
+		}
+		files[header.Name] = BackupFile{Name: header.Name, Size: header.Size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if !found {
+		return m, fmt.Errorf("%w: no %s, the backup is incomplete", ErrInvalidBackup, backupManifest)
+	}
+	if len(m.Files) != len(files) {
+		return m, fmt.Errorf("%w: %d files, %s lists %d", ErrInvalidBackup, len(files), backupManifest, len(m.Files))
+	}
+	for _, file := range m.Files {
+		if files[file.Name] != file {
+			return m, fmt.Errorf("%w: %s does not match its checksum", ErrInvalidBackup, file.Name)
+		}
+	}
+	if _, ok := files[backupSegments]; !ok {
+		return m, fmt.Errorf("%w: no %s", ErrInvalidBackup, backupSegments)
+	}
+	return m, nil
+}
+
+// validBackupName reports whether a name is one of the files a backup is
+// made of. Anything else, like a path, is rejected.
+func validBackupName(name string) bool {
+	switch name {
+	case backupChkFile, backupLogFile, backupSegments:
+		return true
+	}
+	for _, pattern := range []string{backupChkFile + ".delta.[0-9][0-9][0-9][0-9][0-9][0-9]", backupLogFile + ".[0-9][0-9][0-9][0-9][0-9][0-9]"} {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
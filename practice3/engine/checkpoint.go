@@ -0,0 +1,437 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"practice3/util"
+	"sort"
+	"time"
+)
+
+// A checkpoint is a base file with all features and up to maxDeltas delta
+// files with the features changed since the previous checkpoint. Both start
+// with a header holding the vclock they correspond to. Recovery loads the
+// base, applies the deltas in order and then replays the log. Once there are
+// too many deltas the next checkpoint compacts them into a new base.
+
+const (
+	defaultCheckpointSize     = 64 << 20
+	defaultCheckpointCount    = 100000
+	defaultCheckpointInterval = 10 * time.Minute
+	defaultMaxDeltas          = 8
+
+	// checkpointProgress is how many features are written between progress
+	// reports.
+	checkpointProgress = 100000
+)
+
+// CheckpointStatus describes the running or the last finished checkpoint.
+type CheckpointStatus struct {
+	Running  bool              `json:"running"`
+	Delta    bool              `json:"delta"`
+	Written  int64             `json:"written"`
+	Total    int               `json:"total"`
+	Duration string            `json:"duration,omitempty"`
+	VClock   map[string]uint64 `json:"vclock"`
+}
+
+// WithAutoCheckpoint makes the Engine checkpoint in the background once the
+// log grew by size bytes or count transactions since the last checkpoint, or
+// once interval passed and anything was logged. Zero disables a trigger.
+func WithAutoCheckpoint(size int64, count int, interval time.Duration) Option {
+	return func(e *Engine) {
+		e.autoChkSize = size
+		e.autoChkCount = count
+		e.autoChkInterval = interval
+	}
+}
+
+// WithDeltaCheckpoints sets how many delta checkpoints are written before
+// they are compacted into a new base. Zero makes every checkpoint a base.
+func WithDeltaCheckpoints(maxDeltas int) Option {
+	return func(e *Engine) {
+		e.maxDeltas = maxDeltas
+	}
+}
+
+// CheckpointStatus returns the progress of the running checkpoint or the
+// result of the last one.
+func (e *Engine) CheckpointStatus() CheckpointStatus {
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+
+	status := e.chkStatus
+	status.Written = e.chkWritten.Load()
+	return status
+}
+
+// checkpointDue reports whether an automatic checkpoint should start.
+func (e *Engine) checkpointDue() bool {
+	if e.checkpointing || e.chkTxs == 0 {
+		return false
+	}
+	return (e.autoChkSize > 0 && e.chkBytes >= e.autoChkSize) ||
+		(e.autoChkCount > 0 && e.chkTxs >= e.autoChkCount) ||
+		(e.autoChkInterval > 0 && time.Since(e.chkTime) >= e.autoChkInterval)
+}
+
+// checkpointView returns the features to checkpoint and whether they are a
+// delta, together with their versions. A deleted feature is a nil entry of
+// a delta. Stored features are never changed in place, every write stores a
+// new one, so a copy of the index is a consistent view.
+func (e *Engine) checkpointView(compact bool) (map[string]*geojson.Feature, map[string]version, bool) {
+	delta := !compact && !e.needBase && e.hasBase && e.deltas < e.maxDeltas
+
+	var view map[string]*geojson.Feature
+	if delta {
+		view = make(map[string]*geojson.Feature, len(e.changed))
+		for key := range e.changed {
+			view[key] = e.Data[key]
+		}
+	} else {
+		view = make(map[string]*geojson.Feature, len(e.Data))
+		for key, feature := range e.Data {
+			view[key] = feature
+		}
+	}
+
+	versions := make(map[string]version, len(view))
+	for key, feature := range view {
+		if feature != nil {
+			versions[key] = e.versions[key]
+		}
+	}
+
+	e.changed = make(map[string]bool)
+	e.needBase = false
+	return view, versions, delta
+}
+
+// checkpointFile returns the file of the next checkpoint.
+func (e *Engine) checkpointFile(delta bool) string {
+	if delta {
+		return fmt.Sprintf("%s.delta.%06d", e.ChkFile, e.deltas+1)
+	}
+	return e.ChkFile
+}
+
+// startCheckpoint writes a checkpoint in the background, so the run loop
+// keeps serving commands while the view is written.
+func (e *Engine) startCheckpoint() {
+	view, versions, delta := e.checkpointView(false)
+	vclock := e.copyVClock()
+	txTime := e.txTime
+	filename := e.checkpointFile(delta)
+
+	e.checkpointing = true
+	e.beginCheckpoint(len(view), delta, vclock)
+	slog.Info("Checkpoint started", "name", e.name, "delta", delta, "features", len(view))
+
+	go func() {
+		start := time.Now()
+		tmpFile, err := e.writeCheckpointFile(filename, view, versions, delta, vclock, txTime)
+
+		e.Mu.Lock()
+		defer e.Mu.Unlock()
+		e.checkpointing = false
+
+		// A checkpoint requested meanwhile is a newer base
+		if err == nil && behind(vclock, e.chkVClock) {
+			os.Remove(tmpFile)
+			e.chkStatus.Running = false
+			return
+		}
+		if err == nil {
+			err = os.Rename(tmpFile, filename)
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+			e.failCheckpoint(err)
+			return
+		}
+		e.finishCheckpoint(delta, vclock, time.Since(start))
+	}()
+}
+
+// beginCheckpoint resets the status and the triggers. Everything logged
+// from now on is not part of the checkpoint.
+func (e *Engine) beginCheckpoint(total int, delta bool, vclock map[string]uint64) {
+	e.chkStatus = CheckpointStatus{Running: true, Delta: delta, Total: total, VClock: vclock}
+	e.chkWritten.Store(0)
+	e.chkTxs = 0
+	e.chkBytes = 0
+	e.chkTime = time.Now()
+}
+
+// failCheckpoint is called if the checkpoint file was not written. The
+// changes it held are not tracked anymore, so the next one is a base.
+func (e *Engine) failCheckpoint(err error) {
+	e.chkStatus.Running = false
+	e.needBase = true
+	slog.Error("Failed to write checkpoint", "name", e.name, "error", err)
+}
+
+// finishCheckpoint is called once the checkpoint file is in place. A new
+// base makes the deltas obsolete. The log before the checkpoint is kept as
+// long as the retention allows.
+func (e *Engine) finishCheckpoint(delta bool, vclock map[string]uint64, duration time.Duration) {
+	e.chkVClock = vclock
+	e.chkStatus.Running = false
+	e.chkStatus.Duration = duration.String()
+
+	if delta {
+		e.deltas++
+	} else {
+		e.hasBase = true
+		e.removeDeltas()
+	}
+
+	if err := e.rotate(); err != nil {
+		slog.Error("Failed to rotate transaction log", "error", err)
+	}
+
+	slog.Info("Checkpoint created successfully", "name", e.name, "delta", delta, "features", e.chkStatus.Total, "duration", duration)
+}
+
+// deltaFiles returns the delta files in the order they were written.
+func (e *Engine) deltaFiles() []string {
+	files, _ := filepath.Glob(e.ChkFile + ".delta.[0-9][0-9][0-9][0-9][0-9][0-9]")
+	sort.Strings(files)
+	return files
+}
+
+func (e *Engine) removeDeltas() {
+	for _, file := range e.deltaFiles() {
+		if err := os.Remove(file); err != nil {
+			slog.Error("Failed to remove delta checkpoint", "file", file, "error", err)
+		}
+	}
+	e.deltas = 0
+}
+
+// writeCheckpointFile writes the features to a temporary file next to the
+// checkpoint and returns its name. The first record is a header with the
+// vclock and the latest commit time, every other record is a feature with
+// its version as the name and LSN, or the ID of a feature deleted since the
+// previous checkpoint. In FormatJSON the records are lines, otherwise they
+// are framed like the log records.
+func (e *Engine) writeCheckpointFile(filename string, data map[string]*geojson.Feature, versions map[string]version, delta bool, vclock map[string]uint64, txTime int64) (string, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	fail := func(err error) (string, error) {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	w := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(w)
+	write := func(tx util.Transaction) error {
+		if e.format == FormatJSON {
+			return encoder.Encode(tx)
+		}
+		record, err := e.encode(tx)
+		if err != nil {
+			return err
+		}
+		return writeRecord(w, record)
+	}
+
+	header := util.Transaction{Action: "checkpoint", Name: e.name, VClock: vclock, Time: txTime}
+	if delta {
+		header.Action = "checkpoint_delta"
+	}
+	if err := write(header); err != nil {
+		return fail(err)
+	}
+
+	for key, feature := range data {
+		v := versions[key]
+		tx := util.Transaction{Action: "insert", Name: v.name, LSN: v.lsn, Feature: feature}
+		if feature == nil {
+			deleted := geojson.NewFeature(nil)
+			deleted.ID = key
+			tx = util.Transaction{Action: "delete", Name: e.name, Feature: deleted}
+		}
+		if err := write(tx); err != nil {
+			return fail(err)
+		}
+		if written := e.chkWritten.Add(1); written%checkpointProgress == 0 {
+			slog.Info("Checkpoint progress", "name", e.name, "written", written, "total", len(data))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fail(err)
+	}
+	return tmpFile.Name(), nil
+}
+
+// loadCheckpoint restores the data and the vclock from the base checkpoint
+// and its deltas. A delta which is not newer than the base is left over from
+// before the base was written and is skipped. With a target, the checkpoints
+// after it are skipped as well.
+func (e *Engine) loadCheckpoint(target *RecoveryTarget) error {
+	header, err := readCheckpointHeader(e.ChkFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if target != nil && !target.covers(header) {
+		slog.Warn("Skipping checkpoint after the recovery target", "file", e.ChkFile)
+		return nil
+	}
+
+	vclock, err := e.loadCheckpointFile(e.ChkFile, "checkpoint")
+	if err != nil {
+		return err
+	}
+	e.hasBase = true
+	base := vclock
+
+	for _, file := range e.deltaFiles() {
+		header, err := readCheckpointHeader(file)
+		if err != nil {
+			return err
+		}
+		if !behind(base, header.VClock) {
+			slog.Warn("Skipping stale delta checkpoint", "file", file)
+			continue
+		}
+		if target != nil && !target.covers(header) {
+			break
+		}
+		if vclock, err = e.loadCheckpointFile(file, "checkpoint_delta"); err != nil {
+			return err
+		}
+		e.deltas++
+	}
+
+	for name, lsn := range vclock {
+		e.vclock[name] = lsn
+	}
+	e.changed = make(map[string]bool)
+	return nil
+}
+
+// loadCheckpointFile applies the features of a checkpoint file and returns
+// the vclock from its header.
+func (e *Engine) loadCheckpointFile(filename string, action string) (map[string]uint64, error) {
+	var header *util.Transaction
+	err := readCheckpoint(filename, func(tx util.Transaction) error {
+		if header == nil {
+			if tx.Action != action {
+				return fmt.Errorf("checkpoint %s has no header", filename)
+			}
+			header = &tx
+			return nil
+		}
+
+		feature, err := toFeature(tx.Feature)
+		if err != nil {
+			return err
+		}
+		if tx.Action == "delete" {
+			e.remove(featureKey(feature))
+			return nil
+		}
+		e.apply("insert", feature, version{tx.Name, tx.LSN})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("checkpoint %s has no header", filename)
+	}
+	e.txTime = max(e.txTime, header.Time)
+	return header.VClock, nil
+}
+
+// ReadCheckpoint returns the vclock and the features of a base checkpoint.
+func ReadCheckpoint(filename string) (map[string]uint64, []*geojson.Feature, error) {
+	var vclock map[string]uint64
+	var features []*geojson.Feature
+	err := readCheckpoint(filename, func(tx util.Transaction) error {
+		if tx.Action == "checkpoint" {
+			vclock = tx.VClock
+			return nil
+		}
+		feature, err := toFeature(tx.Feature)
+		if err != nil {
+			return err
+		}
+		features = append(features, feature)
+		return nil
+	})
+	return vclock, features, err
+}
+
+var errStopReading = errors.New("stop reading")
+
+func readCheckpointHeader(filename string) (util.Transaction, error) {
+	var header util.Transaction
+	err := readCheckpoint(filename, func(tx util.Transaction) error {
+		header = tx
+		return errStopReading
+	})
+	if errors.Is(err, errStopReading) {
+		return header, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("checkpoint %s has no header", filename)
+	}
+	return header, err
+}
+
+// readCheckpoint calls fn for every record of a checkpoint file.
+func readCheckpoint(filename string, fn func(tx util.Transaction) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readCheckpointFrom(file, fn)
+}
+
+// readCheckpointFrom calls fn for every record of a checkpoint. A checkpoint
+// starting with '{' is made of JSON lines, otherwise of framed records.
+func readCheckpointFrom(r io.Reader, fn func(tx util.Transaction) error) error {
+	reader := bufio.NewReader(r)
+	first, err := reader.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	if first[0] == versionJSON {
+		_, err := readLines(reader, fn)
+		return err
+	}
+
+	_, err = readRecords(reader, func(data []byte) error {
+		tx, err := decode(data)
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"math"
+)
+
+// Distances are great-circle distances in meters between lon/lat points
+// on WGS84. The rtree is searched best-first: a node is visited in the order
+// of the distance to its bounding box, which is never larger than the
+// distance to any feature inside, so features come out nearest first.
+
+// Neighbor is a feature found by a nearest search, its distance and its
+// version.
+type Neighbor struct {
+	Feature  *geojson.Feature
+	Distance float64 // Meters
+	Version  string
+}
+
+// handleNearest returns the k features nearest to the point, ordered by
+// distance. A k of zero is no limit, and features further away than meters
+// are left out unless meters is zero.
+func (e *Engine) handleNearest(point orb.Point, k int, meters float64) []Neighbor {
+	var results []Neighbor
+	e.rtreeIndex.Nearby(
+		func(min, max [2]float64, feature *geojson.Feature, item bool) float64 {
+			if item {
+				return geometryDistance(point, feature.Geometry)
+			}
+			return boundDistance(point, orb.Bound{Min: min, Max: max})
+		},
+		func(min, max [2]float64, feature *geojson.Feature, dist float64) bool {
+			if meters > 0 && dist > meters {
+				return false
+			}
+			results = append(results, Neighbor{Feature: feature, Distance: dist, Version: e.versions[featureKey(feature)].String()})
+			return k <= 0 || len(results) < k
+		},
+	)
+	return results
+}
+
+// geometryDistance returns the distance from the point to the nearest point
+// of the geometry. It is zero inside a polygon.
+func geometryDistance(p orb.Point, g orb.Geometry) float64 {
+	s := newShape(g)
+	if s.inside(p) {
+		return 0
+	}
+
+	dist := math.Inf(1)
+	for _, point := range s.points {
+		dist = min(dist, geo.DistanceHaversine(p, point))
+	}
+	for _, ls := range s.lines {
+		for i := 1; i < len(ls); i++ {
+			dist = min(dist, segmentDistance(p, ls[i-1], ls[i]))
+		}
+	}
+	return dist
+}
+
+// segmentDistance returns the distance from p to the great-circle arc from a
+// to b, using the cross-track and along-track distances.
+func segmentDistance(p, a, b orb.Point) float64 {
+	ap := geo.DistanceHaversine(a, p)
+	ab := geo.DistanceHaversine(a, b)
+	if ab == 0 {
+		return ap
+	}
+
+	theta := (geo.Bearing(a, p) - geo.Bearing(a, b)) * math.Pi / 180
+	if math.Cos(theta) <= 0 {
+		// p lies behind a
+		return ap
+	}
+	delta := ap / orb.EarthRadius
+	crossTrack := math.Asin(math.Sin(delta) * math.Sin(theta))
+	alongTrack := math.Acos(max(-1, min(1, math.Cos(delta)/math.Cos(crossTrack))))
+	if alongTrack*orb.EarthRadius >= ab {
+		return geo.DistanceHaversine(b, p)
+	}
+	return math.Abs(crossTrack) * orb.EarthRadius
+}
+
+// boundDistance returns the distance from the point to the nearest point of
+// a lon/lat bound. Outside its longitudes, the distance along a parallel
+// grows with the difference in longitude, so the nearest point lies on the
+// nearer of the two meridian edges.
+func boundDistance(p orb.Point, b orb.Bound) float64 {
+	if b.Min[0] <= p[0] && p[0] <= b.Max[0] {
+		lat := max(b.Min[1], min(b.Max[1], p[1]))
+		return geo.DistanceHaversine(p, orb.Point{p[0], lat})
+	}
+
+	lon := b.Min[0]
+	if math.Abs(lonDelta(p[0], b.Max[0])) < math.Abs(lonDelta(p[0], b.Min[0])) {
+		lon = b.Max[0]
+	}
+
+	// The nearest point of the whole meridian half, then the nearest one
+	// within the edge, since the distance has a single minimum along it
+	delta := math.Abs(lonDelta(p[0], lon)) * math.Pi / 180
+	lat := math.Copysign(90, p[1])
+	if delta < math.Pi/2 {
+		lat = math.Atan(math.Tan(p[1]*math.Pi/180)/math.Cos(delta)) * 180 / math.Pi
+	}
+	lat = max(b.Min[1], min(b.Max[1], lat))
+	return geo.DistanceHaversine(p, orb.Point{lon, lat})
+}
+
+// lonDelta returns the difference of two longitudes in -180..180.
+func lonDelta(from, to float64) float64 {
+	d := math.Mod(to-from, 360)
+	switch {
+	case d > 180:
+		d -= 360
+	case d < -180:
+		d += 360
+	}
+	return d
+}
@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/orb/geojson"
+	"math"
+	"practice3/util"
+	"sort"
+)
+
+// Format is the encoding of log and checkpoint records.
+type Format int
+
+const (
+	// FormatBinary encodes the geometry as WKB and the rest of a record in
+	// a compact binary form.
+	FormatBinary Format = iota
+	// FormatJSON encodes a record as a JSON transaction.
+	FormatJSON
+)
+
+// Compression applies to records in FormatBinary.
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressZstd
+	CompressSnappy
+)
+
+// The first byte of a record tells its version. JSON records start with '{'
+// and are read as before binary records existed.
+const (
+	versionJSON     = '{'
+	versionBinaryV1 = 1
+)
+
+// Type tags of feature IDs in binary records.
+const (
+	idNone = iota
+	idUint
+	idFloat
+	idString
+	idJSON
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+var errUnknownVersion = errors.New("unknown record version")
+
+// WithEncoding sets how new log and checkpoint records are encoded. Records
+// of any format are read regardless.
+func WithEncoding(format Format, compression Compression) Option {
+	return func(e *Engine) {
+		e.format = format
+		e.compression = compression
+	}
+}
+
+// encode returns the record of a transaction in the Engine's format.
+func (e *Engine) encode(tx util.Transaction) ([]byte, error) {
+	if e.format == FormatJSON {
+		return json.Marshal(tx)
+	}
+
+	body, err := encodeBinary(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.compression {
+	case CompressZstd:
+		body = zstdEncoder.EncodeAll(body, nil)
+	case CompressSnappy:
+		body = snappy.Encode(nil, body)
+	}
+	return append([]byte{versionBinaryV1, byte(e.compression)}, body...), nil
+}
+
+// decode reads a record of any version.
+func decode(data []byte) (util.Transaction, error) {
+	var tx util.Transaction
+	if len(data) == 0 {
+		return tx, errCorruptRecord
+	}
+
+	switch data[0] {
+	case versionJSON:
+		err := json.Unmarshal(data, &tx)
+		return tx, err
+	case versionBinaryV1:
+		if len(data) < 2 {
+			return tx, errCorruptRecord
+		}
+		body := data[2:]
+
+		var err error
+		switch Compression(data[1]) {
+		case CompressNone:
+		case CompressZstd:
+			body, err = zstdDecoder.DecodeAll(body, nil)
+		case CompressSnappy:
+			body, err = snappy.Decode(nil, body)
+		default:
+			err = fmt.Errorf("unknown compression %d", data[1])
+		}
+		if err != nil {
+			return tx, err
+		}
+		return decodeBinary(body)
+	default:
+		return tx, fmt.Errorf("%w %d", errUnknownVersion, data[0])
+	}
+}
+
+// encodeBinary writes the action, name, LSN, vclock, feature and time of a
+// transaction. Strings and byte slices are prefixed with their length. The
+// time comes last, records written before it existed end after the feature.
+func encodeBinary(tx util.Transaction) ([]byte, error) {
+	buf := appendString(nil, tx.Action)
+	buf = appendString(buf, tx.Name)
+	buf = binary.AppendUvarint(buf, tx.LSN)
+
+	names := make([]string, 0, len(tx.VClock))
+	for name := range tx.VClock {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = binary.AppendUvarint(buf, tx.VClock[name])
+	}
+
+	if tx.Feature == nil {
+		return binary.AppendVarint(append(buf, 0), tx.Time), nil
+	}
+	feature, err := toFeature(tx.Feature)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, 1)
+
+	switch id := feature.ID.(type) {
+	case nil:
+		buf = append(buf, idNone)
+	case uint64:
+		buf = binary.AppendUvarint(append(buf, idUint), id)
+	case float64:
+		buf = binary.BigEndian.AppendUint64(append(buf, idFloat), math.Float64bits(id))
+	case string:
+		buf = appendString(append(buf, idString), id)
+	default:
+		data, err := json.Marshal(id)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendBytes(append(buf, idJSON), data)
+	}
+
+	var geometry []byte
+	if feature.Geometry != nil {
+		if geometry, err = wkb.Marshal(feature.Geometry); err != nil {
+			return nil, err
+		}
+	}
+	buf = appendBytes(buf, geometry)
+
+	var properties []byte
+	if len(feature.Properties) > 0 {
+		if properties, err = json.Marshal(feature.Properties); err != nil {
+			return nil, err
+		}
+	}
+	buf = appendBytes(buf, properties)
+	return binary.AppendVarint(buf, tx.Time), nil
+}
+
+func decodeBinary(data []byte) (util.Transaction, error) {
+	var tx util.Transaction
+	r := &binaryReader{data: data}
+
+	tx.Action = r.string()
+	tx.Name = r.string()
+	tx.LSN = r.uvarint()
+
+	if n := r.uvarint(); n > 0 && r.err == nil {
+		tx.VClock = make(map[string]uint64, n)
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			name := r.string()
+			tx.VClock[name] = r.uvarint()
+		}
+	}
+
+	if r.byte() == 0 || r.err != nil {
+		tx.Time = r.time()
+		return tx, r.err
+	}
+	feature := geojson.NewFeature(nil)
+
+	switch r.byte() {
+	case idNone:
+	case idUint:
+		feature.ID = r.uvarint()
+	case idFloat:
+		feature.ID = math.Float64frombits(binary.BigEndian.Uint64(r.next(8)))
+	case idString:
+		feature.ID = r.string()
+	case idJSON:
+		if err := json.Unmarshal(r.bytes(), &feature.ID); err != nil && r.err == nil {
+			r.err = err
+		}
+	default:
+		r.fail()
+	}
+
+	if geometry := r.bytes(); len(geometry) > 0 && r.err == nil {
+		g, err := wkb.Unmarshal(geometry)
+		if err != nil {
+			return tx, err
+		}
+		feature.Geometry = g
+	}
+	if properties := r.bytes(); len(properties) > 0 && r.err == nil {
+		if err := json.Unmarshal(properties, &feature.Properties); err != nil {
+			return tx, err
+		}
+	}
+
+	tx.Feature = feature
+	tx.Time = r.time()
+	return tx, r.err
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(data))), data...)
+}
+
+// binaryReader reads a binary record. The first error sticks, later reads
+// return zero values.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail() {
+	if r.err == nil {
+		r.err = errCorruptRecord
+	}
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.fail()
+		return make([]byte, max(n, 0))
+	}
+	data := r.data[:n]
+	r.data = r.data[n:]
+	return data
+}
+
+func (r *binaryReader) byte() byte {
+	return r.next(1)[0]
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// time reads the optional time at the end of a record.
+func (r *binaryReader) time() int64 {
+	if r.err != nil || len(r.data) == 0 {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
@@ -2,33 +2,77 @@ package engine
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"github.com/tidwall/rtree"
 	"log/slog"
 	"os"
 	"practice3/util"
+	"strconv"
+	"time"
 )
 
-func (e *Engine) handleSelect(rect [2][2]float64) []*geojson.Feature {
+// handleSelect finds the candidates of a select in the rtree and keeps those
+// whose geometry matches the predicate and whose properties match the
+// filter. Any feature outside the rect is disjoint from the query geometry,
+// so disjoint goes through all of them.
+func (e *Engine) handleSelect(rect [2][2]float64, predicate string, geometry orb.Geometry, filter *util.Filter) []*geojson.Feature {
 	var results []*geojson.Feature
-	e.rtreeIndex.Search(rect[0], rect[1], func(min, max [2]float64, feature *geojson.Feature) bool {
-		results = append(results, feature)
+	match := func(min, max [2]float64, feature *geojson.Feature) bool {
+		if !filter.Match(feature.Properties) {
+			return true
+		}
+		if predicate == "" || relate(predicate, feature.Geometry, geometry) {
+			results = append(results, feature)
+		}
 		return true
-	})
+	}
+
+	if predicate == util.Disjoint {
+		e.rtreeIndex.Scan(func(min, max [2]float64, feature *geojson.Feature) bool {
+			if !(orb.Bound{Min: min, Max: max}).Intersects(orb.Bound{Min: rect[0], Max: rect[1]}) {
+				if filter.Match(feature.Properties) {
+					results = append(results, feature)
+				}
+				return true
+			}
+			return match(min, max, feature)
+		})
+		return results
+	}
+	e.rtreeIndex.Search(rect[0], rect[1], match)
 	return results
 }
 
-func (e *Engine) handleInsert(feature *geojson.Feature) {
-	//slog.Info("Inserting feature", "id", feature.ID)
-	e.vclock[e.name]++            // Increment local LSN
-	feature.ID = e.vclock[e.name] // Assign LSN as ID
+var (
+	// ErrDuplicateID is returned for an insert of a feature whose ID is
+	// stored already.
+	ErrDuplicateID = errors.New("feature ID already exists")
+	// ErrNotFound is returned for a write of a feature whose ID is not
+	// stored.
+	ErrNotFound = errors.New("feature not found")
+	// ErrSnapshotBehind is returned for a snapshot which misses transactions
+	// applied here.
+	ErrSnapshotBehind = errors.New("snapshot is behind")
+)
 
-	id := feature.ID.(uint64)
-	e.Data[string(id)] = feature
+// handleInsert stores a new feature under its client ID. A feature without
+// an ID gets the node name and its LSN as the ID, which is unique across
+// shards.
+func (e *Engine) handleInsert(feature *geojson.Feature) error {
+	//slog.Info("Inserting feature", "id", feature.ID)
+	if feature.ID == nil || feature.ID == "" {
+		feature.ID = fmt.Sprintf("%s-%d", e.name, e.vclock[e.name]+1)
+	}
+	if _, ok := e.Data[featureKey(feature)]; ok {
+		return ErrDuplicateID
+	}
+	e.vclock[e.name]++ // Increment local LSN
 
-	bounds := feature.Geometry.Bound()
-	e.rtreeIndex.Insert(bounds.Min, bounds.Max, feature)
-	e.writeTransactionLog("insert", feature)
-	e.broadcastTransaction(util.Transaction{
+	return e.commit(util.Transaction{
 		Action:  "insert",
 		Name:    e.name,
 		LSN:     e.vclock[e.name],
@@ -36,17 +80,22 @@ func (e *Engine) handleInsert(feature *geojson.Feature) {
 	})
 }
 
-func (e *Engine) handleReplace(feature *geojson.Feature) {
-	e.vclock[e.name]++
-	feature.ID = e.vclock[e.name]
+// handleGet returns the stored feature with the ID of the given one, or nil.
+func (e *Engine) handleGet(feature *geojson.Feature) *geojson.Feature {
+	return e.Data[featureKey(feature)]
+}
 
-	id := feature.ID.(uint64)
-	e.Data[string(id)] = feature
+// handleReplace swaps the stored feature with the same ID for the new one.
+func (e *Engine) handleReplace(feature *geojson.Feature, ifMatch []string) error {
+	if _, ok := e.Data[featureKey(feature)]; !ok {
+		return ErrNotFound
+	}
+	if err := e.checkVersion(featureKey(feature), ifMatch); err != nil {
+		return err
+	}
+	e.vclock[e.name]++
 
-	bounds := feature.Geometry.Bound()
-	e.rtreeIndex.Insert(bounds.Min, bounds.Max, feature)
-	e.writeTransactionLog("replace", feature)
-	e.broadcastTransaction(util.Transaction{
+	return e.commit(util.Transaction{
 		Action:  "replace",
 		Name:    e.name,
 		LSN:     e.vclock[e.name],
@@ -54,88 +103,330 @@ func (e *Engine) handleReplace(feature *geojson.Feature) {
 	})
 }
 
-func (e *Engine) handleDelete(feature *geojson.Feature) {
+// handleDelete removes the stored feature with the ID of the given one. Only
+// the ID is logged.
+func (e *Engine) handleDelete(feature *geojson.Feature, ifMatch []string) error {
+	if _, ok := e.Data[featureKey(feature)]; !ok {
+		return ErrNotFound
+	}
+	if err := e.checkVersion(featureKey(feature), ifMatch); err != nil {
+		return err
+	}
+	deleted := geojson.NewFeature(nil)
+	deleted.ID = feature.ID
 	e.vclock[e.name]++
 
-	id := feature.ID.(uint64)
-	delete(e.Data, string(id))
-
-	bounds := feature.Geometry.Bound()
-	e.rtreeIndex.Delete(bounds.Min, bounds.Max, feature)
-	e.writeTransactionLog("delete", feature)
-	e.broadcastTransaction(util.Transaction{
+	return e.commit(util.Transaction{
 		Action:  "delete",
 		Name:    e.name,
 		LSN:     e.vclock[e.name],
-		Feature: feature,
+		Feature: deleted,
 	})
 }
 
-func (e *Engine) handleCheckpoint() {
-	tmpFile, err := os.CreateTemp("", e.ChkFile)
-	if err != nil {
-		slog.Error("Failed to create checkpoint file", "error", err)
+// commit writes a local transaction to the transaction log, applies it and
+// sends it to the Replicas. A transaction which is not logged is dropped.
+func (e *Engine) commit(tx util.Transaction) error {
+	tx.Time = time.Now().UnixNano()
+	if err := e.writeTransactionLog(tx); err != nil {
+		slog.Error("Failed to write transaction log", "lsn", tx.LSN, "error", err)
+		e.vclock[e.name] = tx.LSN - 1
+		return err
+	}
+	e.apply(tx.Action, tx.Feature.(*geojson.Feature), version{tx.Name, tx.LSN})
+	e.txTime = max(e.txTime, tx.Time)
+	e.broadcastTransaction(tx)
+	return nil
+}
+
+// apply changes the indexes according to the action. The version is the
+// one of the write.
+func (e *Engine) apply(action string, feature *geojson.Feature, v version) {
+	switch action {
+	case "insert", "replace":
+		// The old bounds of a replaced feature leave the rtree first
+		e.remove(featureKey(feature))
+		e.Data[featureKey(feature)] = feature
+		e.versions[featureKey(feature)] = v
+
+		bounds := feature.Geometry.Bound()
+		e.rtreeIndex.Insert(bounds.Min, bounds.Max, feature)
+	case "delete":
+		e.remove(featureKey(feature))
+	}
+	e.changed[featureKey(feature)] = true
+}
+
+// remove deletes the stored feature from the indexes. The rtree holds the
+// stored feature, not the one from a request.
+func (e *Engine) remove(key string) {
+	stored, ok := e.Data[key]
+	if !ok {
 		return
 	}
-	defer os.Remove(tmpFile.Name())
+	delete(e.Data, key)
+	delete(e.versions, key)
 
-	for _, feature := range e.Data {
-		transaction := util.Transaction{
-			Action:  "insert",
-			Name:    e.name,
-			LSN:     e.vclock[e.name],
-			Feature: feature,
-		}
+	bounds := stored.Geometry.Bound()
+	e.rtreeIndex.Delete(bounds.Min, bounds.Max, stored)
+	e.changed[key] = true
+}
 
-		data, err := json.Marshal(transaction)
-		if err != nil {
-			slog.Error("Failed to marshal transaction", "error", err)
-			return
+// handleDrop deletes the features which lie entirely inside the rect. It is
+// used to clean up a region after its data moved to another shard.
+func (e *Engine) handleDrop(rect [2][2]float64) int {
+	bound := orb.Bound{Min: rect[0], Max: rect[1]}
+
+	var features []*geojson.Feature
+	e.rtreeIndex.Search(rect[0], rect[1], func(min, max [2]float64, feature *geojson.Feature) bool {
+		if bound.Contains(min) && bound.Contains(max) {
+			features = append(features, feature)
 		}
+		return true
+	})
 
-		tmpFile.Write(append(data, '\n'))
+	dropped := 0
+	for _, feature := range features {
+		if e.handleDelete(feature, nil) == nil {
+			dropped++
+		}
 	}
+	return dropped
+}
 
-	if err := os.Rename(tmpFile.Name(), e.ChkFile); err != nil {
-		slog.Error("Failed to replace checkpoint file", "error", err)
-		return
+// handleCheckpoint saves the data together with the vclock it corresponds
+// to, so a restart restores the same state. It writes a delta with the
+// changed features unless compact is set or there are too many deltas.
+func (e *Engine) handleCheckpoint(compact bool) {
+	// A delta would miss the changes held by the background checkpoint
+	if e.checkpointing {
+		compact = true
 	}
 
-	if err := e.clearTransactionLog(); err != nil {
-		slog.Error("Failed to clear transaction log", "error", err)
+	start := time.Now()
+	view, versions, delta := e.checkpointView(compact)
+	vclock := e.copyVClock()
+	filename := e.checkpointFile(delta)
+	e.beginCheckpoint(len(view), delta, vclock)
+
+	tmpFile, err := e.writeCheckpointFile(filename, view, versions, delta, vclock, e.txTime)
+	if err == nil {
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		e.failCheckpoint(err)
 		return
 	}
 
-	slog.Info("Checkpoint created successfully")
+	e.finishCheckpoint(delta, vclock, time.Since(start))
 }
 
+// handleReplicate applies a transaction received from a replica. The
+// transaction keeps the name and LSN of its origin, so it is logged as is and
+// is not sent further.
 func (e *Engine) handleReplicate(tx util.Transaction) {
+	if !e.replay(&tx) {
+		return
+	}
+	if err := e.writeTransactionLog(tx); err != nil {
+		slog.Error("Failed to write transaction log", "name", tx.Name, "lsn", tx.LSN, "error", err)
+	}
+}
+
+// replay applies a transaction of any origin unless it is already applied.
+func (e *Engine) replay(tx *util.Transaction) bool {
 	// Skip if the transaction is already applied
 	if tx.LSN <= e.vclock[tx.Name] {
-		return
+		return false
 	}
 
 	// Apply the transaction
-	featureJSON, err := json.Marshal(tx.Feature)
+	feature, err := toFeature(tx.Feature)
 	if err != nil {
-		slog.Error("Failed to marshal feature", "error", err)
+		slog.Error("Failed to unmarshal feature", "error", err)
+		return false
+	}
+
+	e.apply(tx.Action, feature, version{tx.Name, tx.LSN})
+	e.vclock[tx.Name] = tx.LSN
+	e.txTime = max(e.txTime, tx.Time)
+	tx.Feature = feature
+	return true
+}
+
+// ack tells the replica which sent a transaction what is applied here.
+func (e *Engine) ack(conn *websocket.Conn) {
+	if conn == nil {
+		return
+	}
+	if err := conn.WriteJSON(util.Transaction{Action: "ack", Name: e.name, VClock: e.copyVClock()}); err != nil {
+		slog.Error("Failed to send ack", "error", err)
+	}
+}
+
+// ackWaiter is a write waiting for n Replicas to acknowledge its LSN.
+type ackWaiter struct {
+	lsn  uint64
+	n    int
+	done chan struct{}
+}
+
+// handleAck remembers the local LSN the replica applied and releases the
+// writes which are acknowledged by enough Replicas now.
+func (e *Engine) handleAck(name string, vclock map[string]uint64) {
+	if vclock[e.name] <= e.acks[name] {
 		return
 	}
+	e.acks[name] = vclock[e.name]
 
-	feature, err := geojson.UnmarshalFeature(featureJSON)
+	waiters := e.waiters[:0]
+	for _, w := range e.waiters {
+		if e.acked(w.lsn) >= w.n {
+			close(w.done)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	e.waiters = waiters
+}
+
+// acked returns the number of Replicas which applied the local LSN.
+func (e *Engine) acked(lsn uint64) int {
+	n := 0
+	for _, acked := range e.acks {
+		if acked >= lsn {
+			n++
+		}
+	}
+	return n
+}
+
+// handleSync sends the replica every logged transaction it has not applied
+// yet. If the retained segments do not reach back to the replica's vclock, a
+// snapshot of the data is sent instead. The replica is registered only
+// afterwards, so it receives the new transactions in order.
+func (e *Engine) handleSync(vclock map[string]uint64, addr string, conn *websocket.Conn) {
+	if behind(vclock, e.logStart()) {
+		if err := e.sendSnapshot(conn); err != nil {
+			slog.Error("Failed to send snapshot", "replica", addr, "error", err)
+			return
+		}
+		slog.Info("Replica bootstrapped from snapshot", "name", e.name, "replica", addr, "features", len(e.Data))
+		e.Replicas[addr] = conn
+		return
+	}
+
+	sent := 0
+	err := e.readSegments(vclock, func(tx util.Transaction) error {
+		if err := conn.WriteJSON(tx); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	})
 	if err != nil {
-		slog.Error("Failed to unmarshal feature", "error", err)
+		slog.Error("Failed to send transaction log", "replica", addr, "error", err)
 		return
 	}
 
-	switch tx.Action {
-	case "insert":
-		e.handleInsert(feature)
-	case "replace":
-		e.handleReplace(feature)
-	case "delete":
-		e.handleDelete(feature)
+	slog.Info("Replica synced", "name", e.name, "replica", addr, "transactions", sent)
+	e.Replicas[addr] = conn
+}
+
+// sendSnapshot streams all features together with the vclock they
+// correspond to.
+func (e *Engine) sendSnapshot(conn *websocket.Conn) error {
+	vclock := e.copyVClock()
+	if err := conn.WriteJSON(util.Transaction{Action: "snapshot_begin", Name: e.name, VClock: vclock}); err != nil {
+		return err
 	}
+	for key, feature := range e.Data {
+		// The name and the LSN are the version of the feature
+		v := e.versions[key]
+		if err := conn.WriteJSON(util.Transaction{Action: "snapshot", Name: v.name, LSN: v.lsn, Feature: feature}); err != nil {
+			return err
+		}
+	}
+	return conn.WriteJSON(util.Transaction{Action: "snapshot_end", Name: e.name, VClock: vclock})
+}
 
-	e.vclock[tx.Name] = tx.LSN
+// handleSnapshot replaces the data with a snapshot received from a replica
+// and saves it as a checkpoint, since the log does not have it. A snapshot
+// which misses transactions applied here is refused, so a former leader does
+// not lose the writes it acknowledged.
+func (e *Engine) handleSnapshot(snapshot []util.Transaction, vclock map[string]uint64) error {
+	for name, lsn := range e.vclock {
+		if vclock[name] < lsn {
+			return fmt.Errorf("%w: %s is at %d here and at %d in the snapshot", ErrSnapshotBehind, name, lsn, vclock[name])
+		}
+	}
+
+	data := make(map[string]*geojson.Feature, len(snapshot))
+	versions := make(map[string]version, len(snapshot))
+	index := rtree.RTreeG[*geojson.Feature]{}
+	for _, tx := range snapshot {
+		feature, err := toFeature(tx.Feature)
+		if err != nil {
+			return fmt.Errorf("snapshot feature: %w", err)
+		}
+		data[featureKey(feature)] = feature
+		versions[featureKey(feature)] = version{tx.Name, tx.LSN}
+
+		bounds := feature.Geometry.Bound()
+		index.Insert(bounds.Min, bounds.Max, feature)
+	}
+
+	e.Data = data
+	e.versions = versions
+	e.rtreeIndex = index
+	e.vclock = make(map[string]uint64, len(vclock))
+	for name, lsn := range vclock {
+		e.vclock[name] = lsn
+	}
+	// Changes and acknowledgements refer to the replaced data
+	e.changed = make(map[string]bool)
+	e.acks = make(map[string]uint64)
+
+	slog.Info("Snapshot loaded", "name", e.name, "features", len(data))
+	e.handleCheckpoint(true)
+	return nil
+}
+
+// behind reports whether the vclock misses transactions of the other one.
+func behind(vclock, other map[string]uint64) bool {
+	for name, lsn := range other {
+		if vclock[name] < lsn {
+			return true
+		}
+	}
+	return false
+}
+
+// toFeature converts a feature decoded as a generic JSON value.
+func toFeature(v any) (*geojson.Feature, error) {
+	if feature, ok := v.(*geojson.Feature); ok {
+		return feature, nil
+	}
+
+	featureJSON, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeature(featureJSON)
+}
+
+// featureKey returns the key of the feature in the primary index. IDs decoded
+// from JSON are float64, so they are formatted the same way as uint64 LSNs.
+func featureKey(feature *geojson.Feature) string {
+	switch id := feature.ID.(type) {
+	case uint64:
+		return strconv.FormatUint(id, 10)
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case string:
+		return id
+	default:
+		return fmt.Sprint(id)
+	}
 }
@@ -1,9 +1,7 @@
 package engine
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"github.com/gorilla/websocket"
 	"github.com/paulmach/orb/geojson"
 	"github.com/tidwall/rtree"
@@ -11,11 +9,14 @@ import (
 	"os"
 	"practice3/util"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Engine struct {
 	Mu         sync.Mutex
 	Data       map[string]*geojson.Feature    // Primary index by ID
+	versions   map[string]version             // ID -> last write
 	rtreeIndex rtree.RTreeG[*geojson.Feature] // Spatial index
 	lsn        uint64
 	TransLog   *os.File
@@ -25,35 +26,111 @@ type Engine struct {
 	CommandCh  chan util.Command
 	Replicas   map[string]*websocket.Conn
 	vclock     map[string]uint64 // Vector clock: node -> LSN
+	chkVClock  map[string]uint64 // Vector clock of the last checkpoint
+	acks       map[string]uint64 // Replica name -> last acknowledged local LSN
+	waiters    []*ackWaiter
 	name       string
 	leader     bool
+
+	// Durability of the transaction log
+	syncMode     SyncMode
+	syncInterval time.Duration
+	dirty        bool // Written since the last fsync
+
+	// Segments of the transaction log
+	segments    []segment // Sealed segments, oldest first
+	active      segment   // Segment written to TransLog
+	segmentSeq  int
+	logSize     int64 // Size of the active segment
+	segmentSize int64
+	segmentAge  time.Duration
+	retainCount int
+	retainAge   time.Duration
+
+	// Automatic checkpoints
+	autoChkSize     int64
+	autoChkCount    int
+	autoChkInterval time.Duration
+	chkTxs          int   // Transactions logged since the last checkpoint
+	chkBytes        int64 // Bytes logged since the last checkpoint
+	chkTime         time.Time
+	checkpointing   bool // A background checkpoint is running
+	chkStatus       CheckpointStatus
+	chkWritten      atomic.Int64
+
+	// Delta checkpoints
+	changed   map[string]bool // Keys changed since the last checkpoint
+	maxDeltas int
+	deltas    int  // Deltas written since the base
+	hasBase   bool // A base checkpoint exists
+	needBase  bool // Changes were lost by a failed checkpoint
+
+	// Encoding of new log and checkpoint records
+	format      Format
+	compression Compression
+
+	// Point-in-time recovery
+	txTime         int64 // Latest commit time of the applied transactions
+	recoveryTarget *RecoveryTarget
 }
 
-func NewEngine(ctx context.Context, transactionLogFile string, name string, leader bool) *Engine {
+// NewEngine creates an Engine and loads its checkpoint and transaction log.
+// By default every transaction is fsynced before it is reported.
+func NewEngine(ctx context.Context, transactionLogFile string, name string, leader bool, opts ...Option) *Engine {
 
 	engine := &Engine{
 		Data:       make(map[string]*geojson.Feature),
+		versions:   make(map[string]version),
 		rtreeIndex: rtree.RTreeG[*geojson.Feature]{},
-		ChkFile:    "checkpoint-*.json",
+		ChkFile:    "checkpoint_" + name + ".json",
 		CommandCh:  make(chan util.Command, 10),
 		Replicas:   make(map[string]*websocket.Conn),
 		vclock:     make(map[string]uint64),
+		acks:       make(map[string]uint64),
 		name:       name,
 		leader:     leader,
+
+		segmentSize: defaultSegmentSize,
+		segmentAge:  defaultSegmentAge,
+		retainCount: defaultRetainCount,
+		retainAge:   defaultRetainAge,
+
+		autoChkSize:     defaultCheckpointSize,
+		autoChkCount:    defaultCheckpointCount,
+		autoChkInterval: defaultCheckpointInterval,
+		chkTime:         time.Now(),
+
+		changed:   make(map[string]bool),
+		maxDeltas: defaultMaxDeltas,
+	}
+	for _, opt := range opts {
+		opt(engine)
 	}
 
-	if err := engine.loadCheckpoint(); err != nil {
+	if err := engine.loadCheckpoint(nil); err != nil {
 		slog.Error("load checkpoint failed", "err", err)
 		return nil
 	}
+	engine.chkVClock = engine.copyVClock()
+	engine.chkStatus.VClock = engine.chkVClock
 
 	if err := engine.loadTransactionLog(transactionLogFile); err != nil {
 		slog.Error("load transaction log failed", "err", err)
 		return nil
 	}
 
+	if engine.recoveryTarget != nil {
+		if err := engine.handleRestore(*engine.recoveryTarget); err != nil {
+			slog.Error("restore failed", "err", err)
+			return nil
+		}
+	}
+
 	engine.ctx, engine.cancel = context.WithCancel(ctx)
 	go engine.run()
+	if engine.syncMode == SyncGroup {
+		go engine.runGroupCommit()
+	}
 
 	return engine
 }
@@ -62,6 +139,14 @@ func (e *Engine) run() {
 	slog.Info("Engine goroutine started")
 	defer slog.Info("Engine goroutine stopped")
 
+	// The interval trigger of automatic checkpoints needs a clock
+	var tick <-chan time.Time
+	if e.autoChkInterval > 0 {
+		ticker := time.NewTicker(e.autoChkInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
 	for {
 		select {
 		case cmd := <-e.CommandCh:
@@ -70,23 +155,56 @@ func (e *Engine) run() {
 			switch cmd.Action {
 			case "insert":
 				//slog.Info("Processing insert command")
-				e.handleInsert(cmd.Feature)
+				e.respond(cmd, e.handleInsert(cmd.Feature))
 			case "replace":
 				//slog.Info("Processing replace command")
-				e.handleReplace(cmd.Feature)
+				e.respond(cmd, e.handleReplace(cmd.Feature, cmd.IfMatch))
 			case "delete":
 				//slog.Info("Processing delete command")
-				e.handleDelete(cmd.Feature)
+				e.respond(cmd, e.handleDelete(cmd.Feature, cmd.IfMatch))
 			case "checkpoint":
 				//slog.Info("Processing checkpoint command")
-				e.handleCheckpoint()
+				e.handleCheckpoint(false)
+				cmd.Response <- struct{}{}
+			case "compact":
+				e.handleCheckpoint(true)
 				cmd.Response <- struct{}{}
 			case "select":
 				//slog.Info("Processing select command")
-				cmd.Response <- e.handleSelect(cmd.Rect)
+				cmd.Response <- e.selection(e.handleSelect(cmd.Rect, cmd.Predicate, cmd.Geometry, cmd.Filter))
+			case "nearest":
+				cmd.Response <- e.handleNearest(cmd.Nearest.Point, cmd.Nearest.K, cmd.Nearest.Meters)
+			case "get":
+				cmd.Response <- e.handleGet(cmd.Feature)
+			case "drop":
+				cmd.Response <- e.handleDrop(cmd.Rect)
 			case "replicate":
 				//slog.Info("Processing replicate command")
 				e.handleReplicate(cmd.Transaction)
+				e.ack(cmd.Conn)
+			case "sync":
+				e.handleSync(cmd.Transaction.VClock, cmd.Addr, cmd.Conn)
+			case "snapshot":
+				err := e.handleSnapshot(cmd.Snapshot, cmd.Transaction.VClock)
+				e.ack(cmd.Conn)
+				cmd.Response <- err
+			case "ack":
+				e.handleAck(cmd.Transaction.Name, cmd.Transaction.VClock)
+			case "restore":
+				target := RecoveryTarget{VClock: cmd.Transaction.VClock}
+				if cmd.Transaction.Time != 0 {
+					target.Time = time.Unix(0, cmd.Transaction.Time)
+				}
+				e.respond(cmd, e.handleRestore(target))
+			}
+			if e.checkpointDue() {
+				e.startCheckpoint()
+			}
+			e.Mu.Unlock()
+		case <-tick:
+			e.Mu.Lock()
+			if e.checkpointDue() {
+				e.startCheckpoint()
 			}
 			e.Mu.Unlock()
 		case <-e.ctx.Done():
@@ -101,80 +219,142 @@ func (e *Engine) Stop() {
 	e.cancel()
 }
 
-// broadcastTransaction sends a transaction to all connected Replicas.
-func (e *Engine) broadcastTransaction(tx util.Transaction) {
-	for _, conn := range e.Replicas {
-		if err := conn.WriteJSON(tx); err != nil {
-			slog.Error("Failed to broadcast transaction", "error", err)
-		}
-	}
+// Done is closed once the Engine is stopped. Commands still queued then are
+// never answered.
+func (e *Engine) Done() <-chan struct{} {
+	return e.ctx.Done()
 }
 
-func (e *Engine) clearTransactionLog() error {
-	if err := e.TransLog.Truncate(0); err != nil {
-		return err
+// respond sends the LSN of an applied write command, or the error if it
+// failed, to the sender. The sender may have stopped waiting, so the response
+// is dropped instead of blocking.
+func (e *Engine) respond(cmd util.Command, err error) {
+	if cmd.Response == nil {
+		return
 	}
-	if _, err := e.TransLog.Seek(0, 0); err != nil {
-		return err
+	var resp any = e.vclock[e.name]
+	if err != nil {
+		resp = err
 	}
-	return nil
+	select {
+	case cmd.Response <- resp:
+	default:
+	}
+}
+
+// Broadcast sends a message to all connected Replicas.
+func (e *Engine) Broadcast(tx util.Transaction) {
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+	e.broadcastTransaction(tx)
 }
 
-func (e *Engine) writeTransactionLog(action string, feature *geojson.Feature) {
-	transaction := util.Transaction{
-		Action:  action,
-		Name:    e.name,
-		LSN:     e.vclock[e.name],
-		Feature: feature,
+// VClock returns a copy of the vector clock.
+func (e *Engine) VClock() map[string]uint64 {
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+	return e.copyVClock()
+}
+
+// WaitForAcks waits until n Replicas acknowledged the local LSN or the
+// timeout passes. It reports whether the LSN is acknowledged.
+func (e *Engine) WaitForAcks(lsn uint64, n int, timeout time.Duration) bool {
+	e.Mu.Lock()
+	if e.acked(lsn) >= n {
+		e.Mu.Unlock()
+		return true
 	}
+	waiter := &ackWaiter{lsn: lsn, n: n, done: make(chan struct{})}
+	e.waiters = append(e.waiters, waiter)
+	e.Mu.Unlock()
 
-	data, err := json.Marshal(transaction)
-	if err != nil {
-		slog.Error("Failed to marshal transaction", "error", err)
-		return
+	select {
+	case <-waiter.done:
+		return true
+	case <-time.After(timeout):
 	}
 
-	e.TransLog.Write(append(data, '\n'))
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+	for i, w := range e.waiters {
+		if w == waiter {
+			e.waiters = append(e.waiters[:i], e.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The acks arrived while the timeout fired
+	return true
 }
 
-func (e *Engine) loadCheckpoint() error {
-	file, err := os.Open(e.ChkFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+func (e *Engine) copyVClock() map[string]uint64 {
+	vclock := make(map[string]uint64, len(e.vclock))
+	for name, lsn := range e.vclock {
+		vclock[name] = lsn
 	}
-	defer file.Close()
+	return vclock
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var tx util.Transaction
-		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
-			return err
+// broadcastTransaction sends a transaction to all connected Replicas.
+func (e *Engine) broadcastTransaction(tx util.Transaction) {
+	for _, conn := range e.Replicas {
+		if err := conn.WriteJSON(tx); err != nil {
+			slog.Error("Failed to broadcast transaction", "error", err)
 		}
-		e.handleReplicate(tx)
 	}
-
-	return scanner.Err()
 }
 
-func (e *Engine) loadTransactionLog(filename string) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+// writeTransactionLog appends a transaction to the log and flushes it
+// according to the sync mode.
+func (e *Engine) writeTransactionLog(transaction util.Transaction) error {
+	data, err := e.encode(transaction)
 	if err != nil {
-		slog.Error("Failed to open transaction log", "error", err)
 		return err
 	}
-	e.TransLog = file
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var tx util.Transaction
-		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
+	if err := writeRecord(e.TransLog, data); err != nil {
+		return err
+	}
+	e.logSize += recordHeaderSize + int64(len(data))
+	e.chkBytes += recordHeaderSize + int64(len(data))
+	e.chkTxs++
+
+	switch e.syncMode {
+	case SyncAlways:
+		if err := e.TransLog.Sync(); err != nil {
 			return err
 		}
-		e.handleReplicate(tx)
+	case SyncGroup:
+		e.dirty = true
 	}
 
-	return scanner.Err()
+	// The transaction is logged already, a failed rotation only delays it
+	if e.shouldRotate() {
+		if err := e.rotate(); err != nil {
+			slog.Error("Failed to rotate transaction log", "error", err)
+		}
+	}
+	return nil
+}
+
+// runGroupCommit fsyncs the transaction log every sync interval if anything
+// was written.
+func (e *Engine) runGroupCommit() {
+	ticker := time.NewTicker(e.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.Mu.Lock()
+			if e.dirty {
+				if err := e.TransLog.Sync(); err != nil {
+					slog.Error("Failed to sync transaction log", "error", err)
+				}
+				e.dirty = false
+			}
+			e.Mu.Unlock()
+		case <-e.ctx.Done():
+			return
+		}
+	}
 }
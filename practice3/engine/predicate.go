@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+	"practice3/util"
+	"sort"
+)
+
+// The rtree only compares bounding boxes. The predicates of a select are
+// tested exactly on the geometries of the candidates it finds. Boundaries
+// count as part of a geometry, so a polygon contains its edges and
+// geometries which touch intersect.
+
+// relate reports whether the geometry of a feature relates to the query
+// geometry by the predicate.
+func relate(predicate string, g orb.Geometry, query orb.Geometry) bool {
+	if g == nil {
+		return false
+	}
+	switch predicate {
+	case util.Within:
+		return covers(query, g)
+	case util.Contains:
+		return covers(g, query)
+	case util.Disjoint:
+		return !intersects(g, query)
+	default:
+		return intersects(g, query)
+	}
+}
+
+// shape is a geometry split into points, lines and polygons. The rings of
+// the polygons are among the lines.
+type shape struct {
+	points   []orb.Point
+	lines    []orb.LineString
+	polygons []orb.Polygon
+}
+
+func newShape(g orb.Geometry) *shape {
+	s := &shape{}
+	s.add(g)
+	return s
+}
+
+func (s *shape) add(g orb.Geometry) {
+	switch g := g.(type) {
+	case orb.Point:
+		s.points = append(s.points, g)
+	case orb.MultiPoint:
+		s.points = append(s.points, g...)
+	case orb.LineString:
+		s.addLine(g)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			s.addLine(ls)
+		}
+	case orb.Ring:
+		s.add(orb.Polygon{g})
+	case orb.Polygon:
+		if len(g) == 0 || len(g[0]) == 0 {
+			return
+		}
+		s.polygons = append(s.polygons, g)
+		for _, ring := range g {
+			ls := orb.LineString(ring)
+			if len(ring) > 0 && !ring.Closed() {
+				ls = append(ls[:len(ls):len(ls)], ring[0])
+			}
+			s.addLine(ls)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			s.add(p)
+		}
+	case orb.Bound:
+		s.add(g.ToPolygon())
+	case orb.Collection:
+		for _, c := range g {
+			s.add(c)
+		}
+	}
+}
+
+// addLine adds a line. A line of one point is a point.
+func (s *shape) addLine(ls orb.LineString) {
+	switch len(ls) {
+	case 0:
+	case 1:
+		s.points = append(s.points, ls[0])
+	default:
+		s.lines = append(s.lines, ls)
+	}
+}
+
+func (s *shape) empty() bool {
+	return len(s.points) == 0 && len(s.lines) == 0
+}
+
+// covers reports whether the point lies on the shape.
+func (s *shape) covers(p orb.Point) bool {
+	for _, point := range s.points {
+		if point == p {
+			return true
+		}
+	}
+	for _, ls := range s.lines {
+		for i := 1; i < len(ls); i++ {
+			if util.OnSegment(p, ls[i-1], ls[i]) {
+				return true
+			}
+		}
+	}
+	return s.inside(p)
+}
+
+// inside reports whether the point lies in one of the polygons, including
+// their edges.
+func (s *shape) inside(p orb.Point) bool {
+	for _, polygon := range s.polygons {
+		if inPolygon(polygon, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// interior reports whether the point lies in one of the polygons but not
+// on any line.
+func (s *shape) interior(p orb.Point) bool {
+	if !s.inside(p) {
+		return false
+	}
+	for _, ls := range s.lines {
+		for i := 1; i < len(ls); i++ {
+			if util.OnSegment(p, ls[i-1], ls[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// intersects reports whether two geometries share at least one point.
+func intersects(a, b orb.Geometry) bool {
+	if !a.Bound().Intersects(b.Bound()) {
+		return false
+	}
+	sa, sb := newShape(a), newShape(b)
+
+	for _, p := range sa.points {
+		if sb.covers(p) {
+			return true
+		}
+	}
+	for _, p := range sb.points {
+		if sa.covers(p) {
+			return true
+		}
+	}
+	for _, la := range sa.lines {
+		for _, lb := range sb.lines {
+			if linesIntersect(la, lb) {
+				return true
+			}
+		}
+	}
+
+	// Without crossing edges, one geometry is either inside a polygon of the
+	// other or apart from it
+	for _, ls := range sb.lines {
+		if sa.inside(ls[0]) {
+			return true
+		}
+	}
+	for _, ls := range sa.lines {
+		if sb.inside(ls[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether every point of b lies in a.
+func covers(a, b orb.Geometry) bool {
+	if !a.Bound().Contains(b.Bound().Min) || !a.Bound().Contains(b.Bound().Max) {
+		return false
+	}
+	sa, sb := newShape(a), newShape(b)
+	if sb.empty() || len(sb.polygons) > 0 && len(sa.polygons) == 0 {
+		return false
+	}
+
+	for _, p := range sb.points {
+		if !sa.covers(p) {
+			return false
+		}
+	}
+	for _, ls := range sb.lines {
+		for i := 1; i < len(ls); i++ {
+			if !sa.coversSegment(ls[i-1], ls[i]) {
+				return false
+			}
+		}
+	}
+
+	// The boundary of b is covered, but a hole of a may still lie inside b
+	for _, ls := range sa.lines {
+		for _, p := range ls {
+			if sb.interior(p) && !sa.interior(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// coversSegment reports whether the segment from p to q lies on the shape.
+// The segment is cut where it meets the lines of the shape, and every piece
+// is covered if its ends and middle are.
+func (s *shape) coversSegment(p, q orb.Point) bool {
+	if p == q {
+		return s.covers(p)
+	}
+
+	dx, dy := q[0]-p[0], q[1]-p[1]
+	length := dx*dx + dy*dy
+	cuts := []float64{0, 1}
+	for _, ls := range s.lines {
+		for i := 1; i < len(ls); i++ {
+			for _, c := range util.Crossings(p, q, ls[i-1], ls[i]) {
+				cuts = append(cuts, ((c[0]-p[0])*dx+(c[1]-p[1])*dy)/length)
+			}
+		}
+	}
+	sort.Float64s(cuts)
+
+	if !s.covers(p) || !s.covers(q) {
+		return false
+	}
+	for i := 1; i < len(cuts); i++ {
+		if cuts[i] == cuts[i-1] {
+			continue
+		}
+		t := (cuts[i-1] + cuts[i]) / 2
+		if !s.covers(orb.Point{p[0] + t*dx, p[1] + t*dy}) {
+			return false
+		}
+	}
+	return true
+}
+
+// linesIntersect reports whether any segments of two lines meet.
+func linesIntersect(a, b orb.LineString) bool {
+	if !a.Bound().Intersects(b.Bound()) {
+		return false
+	}
+	for i := 1; i < len(a); i++ {
+		for j := 1; j < len(b); j++ {
+			if util.SegmentsIntersect(a[i-1], a[i], b[j-1], b[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inPolygon reports whether p lies in the polygon or on its edges. A point
+// on the edge of a hole is on the polygon's boundary.
+func inPolygon(polygon orb.Polygon, p orb.Point) bool {
+	if !planar.RingContains(polygon[0], p) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if planar.RingContains(hole, p) && !onRing(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func onRing(ring orb.Ring, p orb.Point) bool {
+	for i := 1; i < len(ring); i++ {
+		if util.OnSegment(p, ring[i-1], ring[i]) {
+			return true
+		}
+	}
+	return len(ring) > 0 && util.OnSegment(p, ring[len(ring)-1], ring[0])
+}
@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/tidwall/rtree"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"practice3/util"
+	"time"
+)
+
+// A restore rebuilds the state from the newest checkpoint before the target
+// and the log up to the target. The restored state is written as a new base
+// and the old checkpoints and log are moved to <log file>.restore.<time>.
+// The local LSN stays at its value before the restore, so new transactions
+// do not reuse the LSNs of the discarded ones and replicas apply and ack them.
+// Replicas keep the discarded transactions they have, they have to be
+// restored to the same target as well.
+
+// RecoveryTarget is the point a restore stops at. If both limits are set, a
+// transaction has to be within both.
+type RecoveryTarget struct {
+	VClock map[string]uint64 // Last LSN of every origin, nil for no limit. Origins not listed are left out
+	Time   time.Time         // Latest commit time, zero for no limit
+}
+
+// WithRecoveryTarget restores the Engine to the target when it starts.
+func WithRecoveryTarget(target RecoveryTarget) Option {
+	return func(e *Engine) {
+		e.recoveryTarget = &target
+	}
+}
+
+// includes reports whether a transaction is within the target.
+func (t RecoveryTarget) includes(tx util.Transaction) bool {
+	if t.VClock != nil && tx.LSN > t.VClock[tx.Name] {
+		return false
+	}
+	return t.Time.IsZero() || tx.Time <= t.Time.UnixNano()
+}
+
+// covers reports whether everything in a checkpoint is within the target.
+func (t RecoveryTarget) covers(header util.Transaction) bool {
+	if t.VClock != nil && behind(t.VClock, header.VClock) {
+		return false
+	}
+	return t.Time.IsZero() || header.Time <= t.Time.UnixNano()
+}
+
+// handleRestore brings the Engine back to the target. The files are only
+// changed once the state is rebuilt, and a failure to archive them leaves
+// them as they were, so a failed restore keeps the current state.
+func (e *Engine) handleRestore(target RecoveryTarget) error {
+	if e.checkpointing {
+		return errors.New("a checkpoint is running")
+	}
+	if err := e.TransLog.Sync(); err != nil {
+		return err
+	}
+	e.dirty = false
+
+	data, versions, index, vclock, changed, deltas, hasBase, txTime := e.Data, e.versions, e.rtreeIndex, e.vclock, e.changed, e.deltas, e.hasBase, e.txTime
+	rollback := func(err error) error {
+		e.Data, e.versions, e.rtreeIndex, e.vclock, e.changed, e.deltas, e.hasBase, e.txTime = data, versions, index, vclock, changed, deltas, hasBase, txTime
+		return err
+	}
+
+	e.Data = make(map[string]*geojson.Feature)
+	e.versions = make(map[string]version)
+	e.rtreeIndex = rtree.RTreeG[*geojson.Feature]{}
+	e.vclock = make(map[string]uint64)
+	e.changed = make(map[string]bool)
+	e.deltas = 0
+	e.hasBase = false
+	e.txTime = 0
+
+	if err := e.loadCheckpoint(&target); err != nil {
+		return rollback(err)
+	}
+	if behind(e.vclock, e.logStart()) {
+		return rollback(errors.New("the log does not reach back to a checkpoint before the target"))
+	}
+
+	// An origin stops at its first transaction after the target, even if a
+	// later one has an earlier time
+	stopped := make(map[string]bool)
+	err := e.readSegments(e.copyVClock(), func(tx util.Transaction) error {
+		if stopped[tx.Name] || !target.includes(tx) {
+			stopped[tx.Name] = true
+			return nil
+		}
+		e.replay(&tx)
+		return nil
+	})
+	if err != nil {
+		return rollback(err)
+	}
+	if e.vclock[e.name] < vclock[e.name] {
+		e.vclock[e.name] = vclock[e.name]
+	}
+
+	if err := e.archiveHistory(); err != nil {
+		return rollback(err)
+	}
+
+	// Acks of the discarded transactions must not confirm new ones
+	e.acks = make(map[string]uint64)
+	slog.Info("Restored", "name", e.name, "vclock", e.vclock, "features", len(e.Data))
+	return nil
+}
+
+// archiveHistory writes the current state as a new base checkpoint, moves
+// the old checkpoints and log segments to an archive directory and starts an
+// empty log. The new files are prepared first, and the renames are undone if
+// one fails, so on an error the files are as they were.
+func (e *Engine) archiveHistory() error {
+	start := time.Now()
+	view, versions, _ := e.checkpointView(true)
+	vclock := e.copyVClock()
+	e.beginCheckpoint(len(view), false, vclock)
+	fail := func(err error) error {
+		e.failCheckpoint(err)
+		return err
+	}
+
+	tmpFile, err := e.writeCheckpointFile(e.ChkFile, view, versions, false, vclock, e.txTime)
+	if err != nil {
+		return fail(err)
+	}
+	defer os.Remove(tmpFile)
+
+	logFile, err := createLog(e.active.File)
+	if err != nil {
+		return fail(err)
+	}
+	defer func() {
+		if logFile != e.TransLog {
+			logFile.Close()
+			os.Remove(logFile.Name())
+		}
+	}()
+
+	dir := fmt.Sprintf("%s.restore.%d", e.active.File, start.UnixNano())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fail(err)
+	}
+
+	var moved [][2]string
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		moved = append(moved, [2]string{from, to})
+		return nil
+	}
+	undo := func(err error) error {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if err := os.Rename(moved[i][1], moved[i][0]); err != nil {
+				slog.Error("Failed to move back archived file", "file", moved[i][0], "error", err)
+			}
+		}
+		os.Remove(dir)
+		return fail(fmt.Errorf("archive %s: %w", dir, err))
+	}
+
+	files := []string{e.ChkFile, e.active.File, e.active.File + ".segments"}
+	files = append(files, e.deltaFiles()...)
+	for _, seg := range e.segments {
+		files = append(files, seg.File)
+	}
+	for _, file := range files {
+		if err := move(file, filepath.Join(dir, filepath.Base(file))); err != nil && !os.IsNotExist(err) {
+			return undo(err)
+		}
+	}
+	if err := move(tmpFile, e.ChkFile); err != nil {
+		return undo(err)
+	}
+	if err := move(logFile.Name(), e.active.File); err != nil {
+		return undo(err)
+	}
+	active := segment{File: e.active.File, First: vclock, Created: time.Now()}
+	if err := saveManifest(active.File, manifest{Seq: e.segmentSeq, Active: active}); err != nil {
+		return undo(err)
+	}
+
+	e.TransLog.Close()
+	e.TransLog = logFile
+	e.segments = nil
+	e.active = active
+	e.logSize = 0
+	e.deltas = 0
+
+	slog.Info("History archived", "name", e.name, "dir", dir)
+	e.finishCheckpoint(false, vclock, time.Since(start))
+	return nil
+}
+
+// createLog creates an empty log file beside the given one, to be renamed in
+// its place.
+func createLog(filename string) (*os.File, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile.Close()
+
+	file, err := os.OpenFile(tmpFile.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	return file, nil
+}
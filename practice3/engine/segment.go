@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"practice3/util"
+	"time"
+)
+
+// The transaction log is split into segments. The active segment is always
+// written to the log file itself. When it is rotated, it is renamed to
+// <log file>.<number> and sealed, and a new active segment is started. The
+// segments are listed in the <log file>.segments manifest.
+
+const (
+	defaultSegmentSize = 16 << 20
+	defaultSegmentAge  = time.Hour
+	defaultRetainCount = 4
+	defaultRetainAge   = 24 * time.Hour
+)
+
+// segment is one file of the transaction log.
+type segment struct {
+	File    string            `json:"file"`
+	First   map[string]uint64 `json:"first"`          // Vclock before the first transaction
+	Last    map[string]uint64 `json:"last,omitempty"` // Vclock after the last transaction, set when sealed
+	Created time.Time         `json:"created"`
+}
+
+type manifest struct {
+	Seq      int       `json:"seq"`
+	Segments []segment `json:"segments"` // Sealed segments, oldest first
+	Active   segment   `json:"active"`
+}
+
+// WithSegments rotates the active segment once it is larger than size bytes
+// or older than age.
+func WithSegments(size int64, age time.Duration) Option {
+	return func(e *Engine) {
+		e.segmentSize = size
+		e.segmentAge = age
+	}
+}
+
+// WithRetention sets how many sealed segments are kept, and for how long,
+// once a checkpoint covers them. Segments which are not covered by a
+// checkpoint are always kept. An age of zero keeps them regardless of age.
+func WithRetention(count int, age time.Duration) Option {
+	return func(e *Engine) {
+		e.retainCount = count
+		e.retainAge = age
+	}
+}
+
+// loadTransactionLog replays the sealed segments and the active one. A torn
+// tail of the active segment is truncated, a corrupt record followed by more
+// data is an error.
+func (e *Engine) loadTransactionLog(filename string) error {
+	m, err := readManifest(filename)
+	if err != nil {
+		return err
+	}
+	e.segmentSeq = m.Seq
+	e.segments = m.Segments
+	e.active = m.Active
+	if e.active.File == "" {
+		// No rotation happened yet, the whole log is the active segment
+		e.active = segment{File: filename, First: e.copyVClock(), Created: time.Now()}
+	}
+
+	segments := e.segments[:0]
+	for _, seg := range e.segments {
+		if err := e.replaySegment(seg.File); err != nil {
+			if os.IsNotExist(err) {
+				slog.Warn("Skipping missing segment", "segment", seg.File)
+				continue
+			}
+			return fmt.Errorf("segment %s: %w", seg.File, err)
+		}
+		segments = append(segments, seg)
+	}
+	e.segments = segments
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Failed to open transaction log", "error", err)
+		return err
+	}
+	e.TransLog = file
+
+	// A framed record never starts with '{', its length would be far beyond
+	// maxRecordSize
+	var first [1]byte
+	if n, _ := file.ReadAt(first[:], 0); n == 1 && first[0] == versionJSON {
+		return e.convertLog(filename)
+	}
+
+	offset, err := readRecords(file, func(data []byte) error {
+		tx, err := decode(data)
+		if err != nil {
+			return err
+		}
+		e.replay(&tx)
+		return nil
+	})
+	e.logSize = offset
+	if errors.Is(err, errTornRecord) {
+		// The node crashed in the middle of a write, and that write was
+		// never reported, so the torn tail is dropped. It may be the first
+		// record, the active segment is empty after a checkpoint or rotation.
+		slog.Warn("Truncating torn transaction log tail", "file", filename, "offset", offset)
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("transaction log %s at offset %d: %w", filename, offset, err)
+	}
+	return nil
+}
+
+// convertLog replays a transaction log of JSON lines, written before records
+// were framed, and replaces it with a log of framed records. Segments are
+// only sealed from framed logs, so the active one is the only legacy log. A
+// torn last line is dropped like a torn record.
+func (e *Engine) convertLog(filename string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	writer := bufio.NewWriter(tmpFile)
+	var size int64
+	lines, err := readLines(e.TransLog, func(tx util.Transaction) error {
+		e.replay(&tx)
+		data, err := e.encode(tx)
+		if err != nil {
+			return err
+		}
+		size += recordHeaderSize + int64(len(data))
+		return writeRecord(writer, data)
+	})
+	if errors.Is(err, errTornRecord) {
+		slog.Warn("Dropping torn transaction log tail", "file", filename, "offset", lines)
+	} else if err != nil {
+		return fmt.Errorf("transaction log %s at offset %d: %w", filename, lines, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e.TransLog.Close()
+	e.TransLog = file
+	e.logSize = size
+	slog.Info("Transaction log converted to framed records", "file", filename, "bytes", size)
+	return nil
+}
+
+// replaySegment applies the transactions of a sealed segment. Sealed
+// segments were fsynced, so a corrupt record is an error.
+func (e *Engine) replaySegment(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = readRecords(file, func(data []byte) error {
+		tx, err := decode(data)
+		if err != nil {
+			return err
+		}
+		e.replay(&tx)
+		return nil
+	})
+	return err
+}
+
+// shouldRotate reports whether the active segment is full or too old.
+func (e *Engine) shouldRotate() bool {
+	if e.segmentSize > 0 && e.logSize >= e.segmentSize {
+		return true
+	}
+	return e.segmentAge > 0 && e.logSize > 0 && time.Since(e.active.Created) >= e.segmentAge
+}
+
+// rotate seals the active segment and starts a new one. Segments no longer
+// needed by the retention policy are removed.
+func (e *Engine) rotate() error {
+	if e.logSize == 0 {
+		if e.retain() {
+			return e.saveManifest()
+		}
+		return nil
+	}
+
+	if err := e.TransLog.Sync(); err != nil {
+		return err
+	}
+	e.dirty = false
+
+	sealed := e.active
+	sealed.File = fmt.Sprintf("%s.%06d", e.active.File, e.segmentSeq+1)
+	sealed.Last = e.copyVClock()
+	active := segment{File: e.active.File, First: e.copyVClock(), Created: time.Now()}
+
+	// The manifest goes first. If the node crashes before the rename, the
+	// missing segment is skipped and its transactions are still in the log
+	// file.
+	segments := append(e.segments[:len(e.segments):len(e.segments)], sealed)
+	if err := saveManifest(active.File, manifest{Seq: e.segmentSeq + 1, Segments: segments, Active: active}); err != nil {
+		return err
+	}
+	if err := os.Rename(active.File, sealed.File); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(active.File, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e.TransLog.Close()
+	e.TransLog = file
+	e.segmentSeq++
+	e.segments = segments
+	e.active = active
+	e.logSize = 0
+
+	slog.Info("Transaction log rotated", "name", e.name, "segment", sealed.File)
+	if e.retain() {
+		return e.saveManifest()
+	}
+	return nil
+}
+
+// retain removes the oldest sealed segments covered by the last checkpoint
+// which are beyond the retention count or age. It reports whether any
+// segment was removed.
+func (e *Engine) retain() bool {
+	covered := 0
+	for _, seg := range e.segments {
+		if !behind(e.chkVClock, seg.Last) {
+			covered++
+		}
+	}
+
+	kept := e.segments[:0]
+	for _, seg := range e.segments {
+		expired := e.retainAge > 0 && time.Since(seg.Created) >= e.retainAge
+		if !behind(e.chkVClock, seg.Last) && (covered > e.retainCount || expired) {
+			if err := os.Remove(seg.File); err != nil && !os.IsNotExist(err) {
+				slog.Error("Failed to remove segment", "segment", seg.File, "error", err)
+				kept = append(kept, seg)
+				continue
+			}
+			covered--
+			slog.Info("Segment removed", "name", e.name, "segment", seg.File)
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	removed := len(kept) < len(e.segments)
+	e.segments = kept
+	return removed
+}
+
+// logStart returns the vclock before the oldest transaction in the log.
+func (e *Engine) logStart() map[string]uint64 {
+	if len(e.segments) > 0 {
+		return e.segments[0].First
+	}
+	return e.active.First
+}
+
+// readSegments calls fn for every logged transaction which is not covered by
+// the vclock, oldest first.
+func (e *Engine) readSegments(vclock map[string]uint64, fn func(tx util.Transaction) error) error {
+	files := make([]string, 0, len(e.segments)+1)
+	for _, seg := range e.segments {
+		// The replica has the whole segment
+		if !behind(vclock, seg.Last) {
+			continue
+		}
+		files = append(files, seg.File)
+	}
+	files = append(files, e.active.File)
+
+	for _, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		_, err = readRecords(file, func(data []byte) error {
+			tx, err := decode(data)
+			if err != nil {
+				return err
+			}
+			if tx.LSN <= vclock[tx.Name] {
+				return nil
+			}
+			return fn(tx)
+		})
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readManifest(filename string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filename + ".segments")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+// saveManifest writes the current segments to the manifest.
+func (e *Engine) saveManifest() error {
+	return saveManifest(e.active.File, manifest{Seq: e.segmentSeq, Segments: e.segments, Active: e.active})
+}
+
+// saveManifest atomically replaces the manifest of the log file.
+func saveManifest(filename string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename += ".segments"
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"strconv"
+)
+
+// Every stored feature has a version, the origin and the LSN of its last
+// write. Clients send it back in If-Match, so a replace or delete fails if
+// someone else changed the feature since they read it.
+
+// ErrVersionMismatch is returned for a write whose If-Match versions do not
+// include the stored one.
+var ErrVersionMismatch = errors.New("feature version does not match")
+
+type version struct {
+	name string
+	lsn  uint64
+}
+
+func (v version) String() string {
+	return v.name + ":" + strconv.FormatUint(v.lsn, 10)
+}
+
+// Version returns the version of a feature returned by a select or a get. It
+// reports false if the feature was written again meanwhile.
+func (e *Engine) Version(feature *geojson.Feature) (string, bool) {
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+
+	key := featureKey(feature)
+	if e.Data[key] != feature {
+		return "", false
+	}
+	return e.versions[key].String(), true
+}
+
+// Selection is the result of a select. The versions of its features are
+// keyed by ID and taken in the same command, so they match the features.
+type Selection struct {
+	Features []*geojson.Feature
+	Versions map[string]string
+}
+
+// selection adds the versions to the features of a select.
+func (e *Engine) selection(features []*geojson.Feature) Selection {
+	versions := make(map[string]string)
+	for _, feature := range features {
+		if feature.ID != nil {
+			versions[fmt.Sprint(feature.ID)] = e.versions[featureKey(feature)].String()
+		}
+	}
+	return Selection{Features: features, Versions: versions}
+}
+
+// checkVersion returns ErrVersionMismatch unless ifMatch is empty or holds
+// the version of the stored feature. "*" matches any version.
+func (e *Engine) checkVersion(key string, ifMatch []string) error {
+	if len(ifMatch) == 0 {
+		return nil
+	}
+	current := e.versions[key].String()
+	for _, v := range ifMatch {
+		if v == "*" || v == current {
+			return nil
+		}
+	}
+	return ErrVersionMismatch
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"practice3/util"
+	"time"
+)
+
+// SyncMode tells when the transaction log is flushed to the disk.
+//
+//   - SyncAlways: every transaction is fsynced before the write is reported,
+//     so an acknowledged write survives a crash of the node or the machine.
+//   - SyncGroup: the log is fsynced every sync interval, so a machine crash
+//     loses at most the transactions of the last interval.
+//   - SyncNone: the OS decides when to flush. A crash of the process loses
+//     nothing, a crash of the machine may lose anything not yet flushed.
+type SyncMode int
+
+const (
+	SyncAlways SyncMode = iota
+	SyncGroup
+	SyncNone
+)
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// defaultSyncInterval is the interval of SyncGroup if none is given.
+const defaultSyncInterval = 10 * time.Millisecond
+
+// WithSync sets how the transaction log is flushed. The interval is used by
+// SyncGroup only, a non-positive one is the default interval.
+func WithSync(mode SyncMode, interval time.Duration) Option {
+	return func(e *Engine) {
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		e.syncMode = mode
+		e.syncInterval = interval
+	}
+}
+
+// A log record is the length and the CRC32 of the payload followed by the
+// payload itself.
+const recordHeaderSize = 8
+
+// maxRecordSize protects against allocating garbage lengths of a torn record.
+const maxRecordSize = 64 << 20
+
+var (
+	// errCorruptRecord is a record which does not match its checksum and is
+	// followed by more data, so it is not the torn tail of a crash.
+	errCorruptRecord = errors.New("corrupt log record")
+	// errTornRecord is a bad record which runs to the end of the input, as
+	// the last write of a crashed node does.
+	errTornRecord = errors.New("torn log record")
+)
+
+// writeRecord writes one framed record.
+func writeRecord(w io.Writer, data []byte) error {
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	_, err := w.Write(record)
+	return err
+}
+
+// readRecords calls fn for every record. It returns the offset after the last
+// valid record, and errTornRecord if the rest of the input is a cut off or
+// mismatching record which reaches the end, errCorruptRecord if more data
+// follows it.
+func readRecords(r io.Reader, fn func(data []byte) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, recordHeaderSize)
+
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return offset, badRecord(reader, size)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, badRecord(reader, 0)
+		}
+
+		if err := fn(data); err != nil {
+			return offset, err
+		}
+		offset += recordHeaderSize + int64(size)
+	}
+}
+
+// badRecord tells whether a bad record reaches the end of the input. The
+// missing bytes of its payload are not read yet.
+func badRecord(reader io.Reader, missing uint32) error {
+	rest, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return err
+	}
+	if rest <= int64(missing) {
+		return errTornRecord
+	}
+	return errCorruptRecord
+}
+
+// readLines calls fn for every transaction of a log or checkpoint made of
+// JSON lines, as they were written before records were framed. It returns
+// the offset after the last valid line, and errTornRecord if the last line
+// is cut off.
+func readLines(r io.Reader, fn func(tx util.Transaction) error) (int64, error) {
+	reader := bufio.NewReader(r)
+
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return offset, err
+		}
+		if len(line) > maxRecordSize {
+			return offset, errCorruptRecord
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var tx util.Transaction
+			if jsonErr := json.Unmarshal(line, &tx); jsonErr != nil {
+				if err == io.EOF {
+					return offset, errTornRecord
+				}
+				return offset, fmt.Errorf("%w: %v", errCorruptRecord, jsonErr)
+			}
+			if err := fn(tx); err != nil {
+				return offset, err
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			return offset, nil
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.23.5
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
 	github.com/paulmach/orb v0.11.1
 	github.com/tidwall/rtree v1.10.0
 )
@@ -3,42 +3,65 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"practice3/engine"
 	"practice3/storage"
 	"syscall"
 	"time"
 )
 
 func main() {
-	r := http.ServeMux{}
+	verify := flag.String("verify-backup", "", "verify a backup archive and exit")
+	flag.Parse()
+	if *verify != "" {
+		os.Exit(verifyBackup(*verify))
+	}
 
-	storage1 := storage.NewStorage(&r, "node1", []string{"node2", "node3"}, true)
-	storage2 := storage.NewStorage(&r, "node2", []string{"node1", "node3"}, false)
-	storage3 := storage.NewStorage(&r, "node3", []string{"node1", "node2"}, false)
+	r := http.ServeMux{}
+	addr := "127.0.0.1:8080"
 
+	// Every replicaset is a shard, the first node is the leader
 	nodes := [][]string{
 		{"node1", "node2", "node3"},
-		{"node2", "node1", "node3"},
-		{"node3", "node1", "node2"},
+		{"node4", "node5", "node6"},
+	}
+
+	var storages []*storage.Storage
+	for _, replicaset := range nodes {
+		for i, name := range replicaset {
+			// Replicas connect to each other through the same server
+			var replicas []string
+			for _, replica := range replicaset {
+				if replica != name {
+					replicas = append(replicas, addr+"/"+replica)
+				}
+			}
+			s := storage.NewStorage(&r, name, replicas, i == 0)
+			if s == nil {
+				for _, s := range storages {
+					s.Stop()
+				}
+				os.Exit(1)
+			}
+			storages = append(storages, s)
+		}
 	}
 
 	router := NewRouter(&r, nodes)
 
-	go storage1.Run()
-	go storage2.Run()
-	go storage3.Run()
+	for _, s := range storages {
+		go s.Run()
+		defer s.Stop()
+	}
 
 	go router.Run()
 
-	defer storage1.Stop()
-	defer storage2.Stop()
-	defer storage3.Stop()
-
 	l := &http.Server{
-		Addr:    "127.0.0.1:8080",
+		Addr:    addr,
 		Handler: &r,
 	}
 
@@ -59,3 +82,21 @@ func main() {
 		slog.Info("err", "err", err)
 	}
 }
+
+// verifyBackup checks a backup archive offline and returns the exit code.
+func verifyBackup(filename string) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		slog.Error("Failed to open backup", "file", filename, "error", err)
+		return 1
+	}
+	defer file.Close()
+
+	m, err := engine.VerifyBackup(file)
+	if err != nil {
+		slog.Error("Backup is invalid", "file", filename, "error", err)
+		return 1
+	}
+	slog.Info("Backup is valid", "file", filename, "name", m.Name, "vclock", m.VClock, "created", m.Created, "files", len(m.Files))
+	return 0
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"math"
 	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"practice3/engine"
 	"practice3/storage"
 	"practice3/util"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -19,6 +27,17 @@ import (
 
 var testName = "test"
 
+// removeTransactionLog deletes the transaction log of the Storage together
+// with its sealed segments and manifest.
+func removeTransactionLog(t *testing.T, name string) {
+	files, _ := filepath.Glob("transaction_" + name + ".log*")
+	for _, file := range files {
+		if err := os.RemoveAll(file); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete %v: %v", file, err)
+		}
+	}
+}
+
 func setup() (*Router, *storage.Storage, *http.ServeMux) {
 	mux := http.NewServeMux()
 	s := storage.NewStorage(mux, testName, []string{}, true)
@@ -76,8 +95,8 @@ func TestHandleReplication(t *testing.T) {
 	features := <-responseChan
 
 	found := false
-	for _, f := range features.([]*geojson.Feature) {
-		if f.ID.(uint64) == 1 {
+	for _, f := range features.(engine.Selection).Features {
+		if f.ID == "1" {
 			found = true
 			break
 		}
@@ -127,29 +146,18 @@ func TestHandleSelect(t *testing.T) {
 
 	mux.ServeHTTP(rr, req)
 
-	if rr.Code == http.StatusTemporaryRedirect {
-		req, err := http.NewRequest(http.MethodGet, rr.Header().Get("Location")+"?rect="+rect, nil)
-		if err != nil {
-			t.Fatal(err)
-		}
-		rr = httptest.NewRecorder()
-		mux.ServeHTTP(rr, req)
-
-		if rr.Code != http.StatusOK {
-			t.Fatalf("Failed to insert feature: got status %v", rr.Code)
-		}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: got %v", rr.Body.String())
+	}
 
-		var result geojson.FeatureCollection
-		err = json.NewDecoder(rr.Body).Decode(&result)
-		if err != nil {
-			t.Fatalf("Failed to decode response: %v", err)
-		}
+	var result geojson.FeatureCollection
+	err := json.NewDecoder(rr.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
 
-		if len(result.Features) != 1 || result.Features[0].ID.(float64) != 1 {
-			t.Errorf("Unexpected result: got %+v", result)
-		}
-	} else {
-		t.Fatalf("Unexpected response: got %v", rr.Body.String())
+	if len(result.Features) != 1 || result.Features[0].ID != "1" {
+		t.Errorf("Unexpected result: got %+v", result)
 	}
 }
 
@@ -265,51 +273,37 @@ func TestHandleDelete(t *testing.T) {
 
 	feature := geojson.NewFeature(orb.Point{1.0, 2.0})
 	feature.ID = "1"
-	featureCollection := geojson.NewFeatureCollection()
-	featureCollection.Append(feature)
-
-	write, _ := featureCollection.MarshalJSON()
-	err := os.WriteFile(s.DataFile, write, 0644)
-	if err != nil {
-		t.Fatalf("Failed to write test data: %v", err)
-	}
-	defer os.Remove(s.DataFile)
+	b, _ := feature.MarshalJSON()
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(b)))
 
-	deleteFeature := geojson.NewFeature(orb.Point{})
-	deleteFeature.ID = "1"
-	body, _ := json.Marshal(deleteFeature)
+	// The ID alone is enough
+	body := []byte(`{"id":"1"}`)
 
 	req := httptest.NewRequest(http.MethodPost, "/delete", bytes.NewReader(body))
 	rr := httptest.NewRecorder()
 
 	mux.ServeHTTP(rr, req)
 
-	if rr.Code == http.StatusTemporaryRedirect {
-		req, _ = http.NewRequest(http.MethodPost, rr.Header().Get("Location"), bytes.NewReader(body))
-		rr = httptest.NewRecorder()
-		mux.ServeHTTP(rr, req)
-
-		if rr.Code != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
-		}
-
-		data, err := os.ReadFile(s.DataFile)
-		if err != nil {
-			t.Fatalf("Failed to read storage file: %v", err)
-		}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
 
-		var result geojson.FeatureCollection
-		err = json.Unmarshal(data, &result)
-		if err != nil {
-			t.Fatalf("Failed to decode storage file: %v", err)
-		}
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+	if features := (<-responseChan).(engine.Selection).Features; len(features) != 0 {
+		t.Errorf("Feature was not deleted, got %+v", features)
+	}
+	if lsn := s.Engine.VClock()[testName]; lsn != 2 {
+		t.Errorf("Delete was not logged: got LSN %v want %v", lsn, 2)
+	}
 
-		if len(result.Features) != 0 {
-			t.Errorf("Feature was not deleted, got %+v", result.Features)
-		}
+	// The feature is gone
+	req = httptest.NewRequest(http.MethodPost, "/delete?id=1", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
 
-	} else if rr.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
 	}
 }
 
@@ -317,9 +311,7 @@ func TestHandleCheckpoint(t *testing.T) {
 	r, s, mux := setup()
 
 	t.Cleanup(func() {
-		if err := os.Remove("transaction_" + testName + ".log"); err != nil && !os.IsNotExist(err) {
-			t.Errorf("Failed to delete transaction.log: %v", err)
-		}
+		removeTransactionLog(t, testName)
 		if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
 			t.Errorf("Failed to delete checkpoint-*.json: %v", err)
 		}
@@ -362,38 +354,14 @@ func TestHandleCheckpoint(t *testing.T) {
 			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
 		}
 
-		// Verify checkpoint file
-		checkpointData, err := os.ReadFile(s.Engine.ChkFile)
+		// Verify checkpoint file, the header holds the vclock of the checkpoint
+		vclock, checkpointFeatures, err := engine.ReadCheckpoint(s.Engine.ChkFile)
 		if err != nil {
 			t.Fatalf("Failed to read checkpoint file: %v", err)
 		}
 
-		var checkpointFeatures []geojson.Feature
-		lines := strings.Split(string(checkpointData), "\n")
-		for _, line := range lines {
-			if line == "" {
-				continue
-			}
-			var transaction struct {
-				Action  string      `json:"action"`
-				LSN     uint64      `json:"lsn"`
-				Feature interface{} `json:"feature"`
-			}
-			if err := json.Unmarshal([]byte(line), &transaction); err != nil {
-				t.Fatalf("Failed to unmarshal checkpoint transaction: %v", err)
-			}
-
-			featureJSON, err := json.Marshal(transaction.Feature)
-			if err != nil {
-				t.Fatalf("Failed to marshal feature: %v", err)
-			}
-
-			feature, err := geojson.UnmarshalFeature(featureJSON)
-			if err != nil {
-				t.Fatalf("Failed to unmarshal feature: %v", err)
-			}
-
-			checkpointFeatures = append(checkpointFeatures, *feature)
+		if vclock[testName] != 2 {
+			t.Errorf("Unexpected checkpoint vclock: got %v", vclock)
 		}
 
 		if len(checkpointFeatures) != 2 {
@@ -461,8 +429,8 @@ func TestConnectToReplicas(t *testing.T) {
 
 	// Check if the feature was added
 	found := false
-	for _, f := range features.([]*geojson.Feature) {
-		if f.ID.(uint64) == 1 {
+	for _, f := range features.(engine.Selection).Features {
+		if f.ID == "1" {
 			found = true
 			break
 		}
@@ -472,3 +440,2182 @@ func TestConnectToReplicas(t *testing.T) {
 		t.Errorf("Feature was not replicated: got %+v", features)
 	}
 }
+
+func TestRouterSharding(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "shard1", []string{}, true)
+	s2 := storage.NewStorage(mux, "shard2", []string{}, true)
+	r := NewRouter(mux, [][]string{{"shard1"}, {"shard2"}})
+
+	t.Cleanup(func() {
+		for _, name := range []string{"shard1", "shard2"} {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	// Two shards split the map into the west and the east sectors
+	tests := []struct {
+		point orb.Point
+		shard *storage.Storage
+	}{
+		{orb.Point{-100, 0}, s1},
+		{orb.Point{100, 0}, s2},
+	}
+
+	for _, tt := range tests {
+		body, _ := json.Marshal(geojson.NewFeature(tt.point))
+		req := httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+
+		responseChan := make(chan any)
+		tt.shard.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{tt.point, tt.point}, Response: responseChan}
+		features := <-responseChan
+
+		if len(features.(engine.Selection).Features) != 1 {
+			t.Errorf("Feature %v was not routed to its shard: got %+v", tt.point, features)
+		}
+	}
+
+	// A feature crossing the border is written to both shards
+	body, _ := json.Marshal(geojson.NewFeature(orb.LineString{{-1, 0}, {1, 0}}))
+	req := httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	for _, s := range []*storage.Storage{s1, s2} {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{-1, -0.5}, {1, 0.5}}, Response: responseChan}
+		features := <-responseChan
+
+		if len(features.(engine.Selection).Features) != 1 {
+			t.Errorf("Feature was not written to every shard: got %+v", features)
+		}
+	}
+}
+
+func TestRouterPartialInsert(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "partwest", []string{}, true)
+	s2 := storage.NewStorage(mux, "parteast", []string{}, true)
+	r := NewRouter(mux, [][]string{{"partwest"}, {"parteast"}})
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "partwest")
+		removeTransactionLog(t, "parteast")
+	})
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	insert := func(id string, geometry orb.Geometry) int {
+		feature := geojson.NewFeature(geometry)
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body)))
+		return rr.Code
+	}
+	get := func(node string, id string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+node+"/get?id="+id, nil))
+		return rr
+	}
+
+	// Each shard has a feature whose ID the other one does not know, so a
+	// crossing feature with that ID fails on one shard, whichever is first
+	taken := map[string]orb.Point{"partwest": {-100, 0}, "parteast": {100, 0}}
+	for node, point := range taken {
+		if code := insert(node, point); code != http.StatusOK {
+			t.Fatalf("Insert failed: got %v", code)
+		}
+	}
+
+	for node := range taken {
+		other := "parteast"
+		if node == "parteast" {
+			other = "partwest"
+		}
+		if code := insert(node, orb.LineString{{-5, 0}, {5, 0}}); code != http.StatusConflict {
+			t.Errorf("Unexpected status for a taken ID on %s: got %v want %v", node, code, http.StatusConflict)
+		}
+		if rr := get(other, node); rr.Code != http.StatusNotFound {
+			t.Errorf("Failed insert is left on %s: got %v", other, rr.Code)
+		}
+		if rr := get(node, node); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Point"`) {
+			t.Errorf("Feature on %s was changed: got %v %s", node, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRouterSelect(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "shard1", []string{}, true)
+	s2 := storage.NewStorage(mux, "shard2", []string{}, true)
+	r := NewRouter(mux, [][]string{{"shard1"}, {"shard2"}})
+
+	t.Cleanup(func() {
+		for _, name := range []string{"shard1", "shard2"} {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	// The line is stored on both shards, the point only on the west one
+	line, _ := json.Marshal(geojson.NewFeature(orb.LineString{{-1, 0}, {1, 0}}))
+	point, _ := json.Marshal(geojson.NewFeature(orb.Point{-1, 1}))
+
+	req := httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(line))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodPost, "/shard1/insert", bytes.NewReader(point))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	tests := []struct {
+		rect  string
+		count int
+	}{
+		{"-2,-2,2,2", 2},
+		{"-2,-2,-0.5,2", 2},
+		{"0.5,-2,2,2", 1},
+		{"10,10,20,20", 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/select?rect="+tt.rect, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+
+		var result geojson.FeatureCollection
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		if len(result.Features) != tt.count {
+			t.Errorf("rect %v: got %v features, want %v", tt.rect, len(result.Features), tt.count)
+		}
+	}
+}
+
+func TestRouterRebalance(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "shard1", []string{}, true)
+	s2 := storage.NewStorage(mux, "shard2", []string{}, true)
+	r := NewRouter(mux, [][]string{{"shard1"}, {"shard2"}})
+
+	t.Cleanup(func() {
+		for _, name := range []string{"shard1", "shard2"} {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	for _, point := range []orb.Point{{45, 10}, {135, 10}} {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	count := func(node *storage.Storage, rect [2][2]float64) int {
+		responseChan := make(chan any)
+		node.Engine.CommandCh <- util.Command{Action: "select", Rect: rect, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	outer := [2][2]float64{{90, -90}, {180, 90}}
+
+	// The east sector is split into the inner and the outer halves, the
+	// outer half moves to shard1
+	req := httptest.NewRequest(http.MethodPost, "/rebalance?action=split&point=135,10&target=shard1", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if count(s1, outer) != 1 || count(s2, outer) != 0 {
+		t.Errorf("Feature was not moved to shard1")
+	}
+
+	selectCount := func(rect string) int {
+		req := httptest.NewRequest(http.MethodGet, "/select?rect="+rect, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		var result geojson.FeatureCollection
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return len(result.Features)
+	}
+
+	// Every feature is returned once
+	if n := selectCount("0,-90,180,90"); n != 2 {
+		t.Errorf("Unexpected number of features after split: got %v want %v", n, 2)
+	}
+
+	// Writes go to the new owner
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{150, 20}))
+	req = httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if count(s1, [2][2]float64{{150, 20}, {150, 20}}) != 1 || count(s2, [2][2]float64{{150, 20}, {150, 20}}) != 0 {
+		t.Errorf("Write was not routed to the new owner")
+	}
+
+	// Merging the east halves back gives the whole sector to shard2
+	req = httptest.NewRequest(http.MethodPost, "/rebalance?action=merge&rect=0,-90,180,90&target=shard2", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if count(s2, outer) != 2 || count(s1, outer) != 0 {
+		t.Errorf("Features were not moved back to shard2")
+	}
+
+	if n := selectCount("0,-90,180,90"); n != 3 {
+		t.Errorf("Unexpected number of features after merge: got %v want %v", n, 3)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	names := []string{"elect1", "elect2", "elect3"}
+
+	var storages []*storage.Storage
+	for i, name := range names {
+		var replicas []string
+		for _, replica := range names {
+			if replica != name {
+				replicas = append(replicas, host+"/"+replica)
+			}
+		}
+		s := storage.NewStorage(mux, name, replicas, i == 0)
+		storages = append(storages, s)
+		t.Cleanup(s.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	// waitForLeader waits until all Storages agree on one leader
+	waitForLeader := func() (string, uint64) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			leader, term := storages[0].Leader()
+			agreed := leader != ""
+			for _, s := range storages[1:] {
+				l, tm := s.Leader()
+				agreed = agreed && l == leader && tm == term
+			}
+			if agreed {
+				return leader, term
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Storages did not agree on a leader")
+		return "", 0
+	}
+
+	leader, term := waitForLeader()
+	if leader != "elect1" {
+		t.Errorf("Unexpected leader: got %v want %v", leader, "elect1")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/elect1/stepdown", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// One of the followers takes over in a newer term
+	time.Sleep(100 * time.Millisecond)
+	newLeader, newTerm := waitForLeader()
+	if newLeader == "elect1" || newTerm <= term {
+		t.Errorf("Leader did not change: got %v in term %v", newLeader, newTerm)
+	}
+
+	if storages[0].IsLeader() {
+		t.Errorf("Stepped down Storage is still a leader")
+	}
+}
+
+func TestVoteUpToDate(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	voter := storage.NewStorage(mux, "voter", []string{}, true)
+	t.Cleanup(func() { removeTransactionLog(t, "voter") })
+	t.Cleanup(voter.Stop)
+
+	for i := 1; i <= 2; i++ {
+		body, _ := json.Marshal(geojson.NewFeature(orb.Point{float64(i), float64(i)}))
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/voter/insert", bytes.NewReader(body)))
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/voter/replication"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	vote := func(term uint64, vclock map[string]uint64) bool {
+		if err := conn.WriteJSON(util.Transaction{Action: "request_vote", Name: "candidate", Term: term, VClock: vclock}); err != nil {
+			t.Fatalf("Failed to request vote: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var tx util.Transaction
+			if err := conn.ReadJSON(&tx); err != nil {
+				t.Fatalf("Failed to read vote: %v", err)
+			}
+			if tx.Action == "vote" {
+				return tx.Granted
+			}
+		}
+	}
+
+	// Far ahead on its own origin, but behind on the voter's
+	if vote(5, map[string]uint64{"voter": 1, "candidate": 10}) {
+		t.Errorf("Vote granted to a candidate behind on one origin")
+	}
+	if !vote(6, map[string]uint64{"voter": 2}) {
+		t.Errorf("Vote refused to an up to date candidate")
+	}
+}
+
+func TestFollowerWrites(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	leader := storage.NewStorage(mux, "follow1", []string{host + "/follow2"}, true)
+	follower := storage.NewStorage(mux, "follow2", []string{host + "/follow1"}, false)
+
+	// The Router still thinks the follower is the leader
+	r := NewRouter(mux, [][]string{{"follow2", "follow1"}})
+
+	t.Cleanup(func() {
+		for _, name := range []string{"follow1", "follow2"} {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	t.Cleanup(r.Stop)
+	t.Cleanup(leader.Stop)
+	t.Cleanup(follower.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for name, _ := follower.Leader(); name != "follow1"; name, _ = follower.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not learn the leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{1.0, 2.0}))
+
+	req := httptest.NewRequest(http.MethodPost, "/follow2/insert", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+	}
+	if rr.Header().Get("X-Leader") != "follow1" || rr.Header().Get("Location") != "/follow1/insert" {
+		t.Errorf("Follower did not point to the leader: got %v", rr.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	responseChan := make(chan any)
+	leader.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {3, 3}}, Response: responseChan}
+	features := <-responseChan
+
+	if len(features.(engine.Selection).Features) != 1 {
+		t.Errorf("Write was not forwarded to the leader: got %+v", features)
+	}
+}
+
+func TestReplicaCatchUp(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "catchup", []string{}, true)
+
+	t.Cleanup(func() {
+		if err := os.Remove("transaction_catchup.log"); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete transaction.log: %v", err)
+		}
+	})
+	t.Cleanup(s.Stop)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	insert := func(point orb.Point) {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/catchup/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Written while the replica is disconnected
+	insert(orb.Point{1, 1})
+	insert(orb.Point{2, 2})
+	insert(orb.Point{3, 3})
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/catchup/replication"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	// The replica has applied the first transaction only
+	if err := conn.WriteJSON(util.Transaction{Action: "sync", Name: "replica", VClock: map[string]uint64{"catchup": 1}}); err != nil {
+		t.Fatalf("Failed to send sync: %v", err)
+	}
+
+	insert(orb.Point{4, 4})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lsns []uint64
+	for len(lsns) < 3 {
+		var tx util.Transaction
+		if err := conn.ReadJSON(&tx); err != nil {
+			t.Fatalf("Failed to read transaction: %v", err)
+		}
+		if tx.Action == "heartbeat" {
+			continue
+		}
+		lsns = append(lsns, tx.LSN)
+	}
+
+	for i, lsn := range lsns {
+		if lsn != uint64(i+2) {
+			t.Errorf("Unexpected transactions: got LSNs %v want [2 3 4]", lsns)
+			break
+		}
+	}
+}
+
+func TestSnapshotTransfer(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	// The log before a checkpoint is not retained
+	leader := storage.NewStorage(mux, "snap1", []string{}, true, engine.WithRetention(0, 0))
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "snap1")
+		removeTransactionLog(t, "snap2")
+		if err := os.Remove(leader.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+	t.Cleanup(leader.Stop)
+
+	insert := func(point orb.Point) {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/snap1/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The checkpoint truncates the log, so it cannot be replayed from the start
+	insert(orb.Point{1, 1})
+	insert(orb.Point{2, 2})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/snap1/checkpoint", nil))
+	insert(orb.Point{3, 3})
+
+	replica := storage.NewStorage(mux, "snap2", []string{host + "/snap1"}, false)
+	t.Cleanup(replica.Stop)
+	t.Cleanup(func() {
+		if err := os.Remove(replica.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+
+	count := func() int {
+		responseChan := make(chan any)
+		replica.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	waitFor := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for count() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Replica has %v features, want %v", count(), n)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitFor(3)
+	if lsn := replica.Engine.VClock()["snap1"]; lsn != 3 {
+		t.Errorf("Unexpected vclock after snapshot: got %v want %v", lsn, 3)
+	}
+
+	// Incremental replication continues after the snapshot
+	insert(orb.Point{4, 4})
+	waitFor(4)
+
+	// A snapshot missing transactions applied here is refused
+	responseChan := make(chan any)
+	replica.Engine.CommandCh <- util.Command{
+		Action:      "snapshot",
+		Transaction: util.Transaction{VClock: map[string]uint64{"snap1": 2}},
+		Response:    responseChan,
+	}
+	if err, _ := (<-responseChan).(error); !errors.Is(err, engine.ErrSnapshotBehind) {
+		t.Errorf("Stale snapshot is not refused: got %v", err)
+	}
+	if n, lsn := count(), replica.Engine.VClock()["snap1"]; n != 4 || lsn != 4 {
+		t.Errorf("Stale snapshot replaced the data: got %v features at LSN %v", n, lsn)
+	}
+}
+
+func TestWriteConcern(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// The third node of the replicaset is down
+	host := strings.TrimPrefix(server.URL, "http://")
+	leader := storage.NewStorage(mux, "quorum1", []string{host + "/quorum2", host + "/quorum3"}, true)
+	follower := storage.NewStorage(mux, "quorum2", []string{host + "/quorum1", host + "/quorum3"}, false)
+
+	t.Cleanup(func() {
+		for _, name := range []string{"quorum1", "quorum2"} {
+			if err := os.Remove("transaction_" + name + ".log"); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Failed to delete transaction.log: %v", err)
+			}
+		}
+	})
+
+	t.Cleanup(leader.Stop)
+	t.Cleanup(follower.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for name, _ := follower.Leader(); name != "quorum1"; name, _ = follower.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not learn the leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tests := []struct {
+		concern string
+		code    int
+	}{
+		{"local", http.StatusOK},
+		{"majority", http.StatusOK},
+		{"all", http.StatusGatewayTimeout},
+		{"some", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		body, _ := json.Marshal(geojson.NewFeature(orb.Point{1.0, 2.0}))
+		req := httptest.NewRequest(http.MethodPost, "/quorum1/insert?write_concern="+tt.concern, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Errorf("Write concern %v: got %v want %v", tt.concern, rr.Code, tt.code)
+		}
+	}
+
+	// A majority write is on the follower once it is acknowledged
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{1.0, 2.0}))
+	req := httptest.NewRequest(http.MethodPost, "/quorum1/insert", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if lsn := follower.Engine.VClock()["quorum1"]; lsn != 4 {
+		t.Errorf("Acknowledged write is not on the follower: got LSN %v want %v", lsn, 4)
+	}
+}
+
+func TestSlowEngineWrite(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "slow", []string{}, true)
+
+	t.Cleanup(func() { removeTransactionLog(t, "slow") })
+	t.Cleanup(s.Stop)
+
+	// The Engine is busy for longer than a write waits for acknowledgements
+	s.Engine.Mu.Lock()
+	go func() {
+		time.Sleep(2500 * time.Millisecond)
+		s.Engine.Mu.Unlock()
+	}()
+
+	feature := geojson.NewFeature(orb.Point{1, 2})
+	feature.ID = "slow"
+	body, _ := json.Marshal(feature)
+	req := httptest.NewRequest(http.MethodPost, "/slow/insert", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	// The write is applied once the Engine gets to it, so it is reported
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == "" {
+		t.Errorf("Slow write is not reported as applied: got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTornTransactionLog(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "torn", []string{}, true)
+
+	t.Cleanup(func() {
+		if err := os.Remove("transaction_torn.log"); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete transaction.log: %v", err)
+		}
+	})
+
+	insert := func(mux *http.ServeMux, point orb.Point) int {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/torn/insert", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	insert(mux, orb.Point{1, 1})
+	insert(mux, orb.Point{2, 2})
+	s.Stop()
+
+	info, err := os.Stat("transaction_torn.log")
+	if err != nil {
+		t.Fatalf("Failed to stat transaction log: %v", err)
+	}
+
+	// The node was killed in the middle of writing a record
+	file, err := os.OpenFile("transaction_torn.log", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open transaction log: %v", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 0xde, 0xad, '{', '"'})
+	file.Close()
+
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "torn", []string{}, true, engine.WithSync(engine.SyncGroup, 10*time.Millisecond))
+	t.Cleanup(s.Stop)
+
+	if lsn := s.Engine.VClock()["torn"]; lsn != 2 {
+		t.Errorf("Unexpected LSN after recovery: got %v want %v", lsn, 2)
+	}
+
+	truncated, err := os.Stat("transaction_torn.log")
+	if err != nil {
+		t.Fatalf("Failed to stat transaction log: %v", err)
+	}
+	if truncated.Size() != info.Size() {
+		t.Errorf("Torn tail was not truncated: got size %v want %v", truncated.Size(), info.Size())
+	}
+
+	if code := insert(mux, orb.Point{3, 3}); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if lsn := s.Engine.VClock()["torn"]; lsn != 3 {
+		t.Errorf("Unexpected LSN after write: got %v want %v", lsn, 3)
+	}
+	s.Stop()
+
+	// A bad record followed by valid ones is not a torn write, so the node
+	// does not start and the log is kept
+	data, err := os.ReadFile("transaction_torn.log")
+	if err != nil {
+		t.Fatalf("Failed to read transaction log: %v", err)
+	}
+	corrupt := slices.Clone(data)
+	corrupt[10] ^= 0xff
+	if err := os.WriteFile("transaction_torn.log", corrupt, 0644); err != nil {
+		t.Fatalf("Failed to write transaction log: %v", err)
+	}
+	if e := engine.NewEngine(context.Background(), "transaction_torn.log", "torn", true); e != nil {
+		e.Stop()
+		t.Errorf("Engine started with a corrupt log")
+	}
+	if kept, err := os.ReadFile("transaction_torn.log"); err != nil || !bytes.Equal(kept, corrupt) {
+		t.Errorf("The corrupt log was changed: got %v bytes want %v", len(kept), len(corrupt))
+	}
+	if s := storage.NewStorage(http.NewServeMux(), "torn", []string{}, true); s != nil {
+		s.Stop()
+		t.Errorf("Storage started with a corrupt log")
+	}
+}
+
+func TestTornFirstRecord(t *testing.T) {
+	mux := http.NewServeMux()
+	// Every write is rotated into a sealed segment, so the active one is
+	// empty again after it
+	opts := []engine.Option{engine.WithSegments(1, 0)}
+	s := storage.NewStorage(mux, "tornfirst", []string{}, true, opts...)
+
+	t.Cleanup(func() { removeTransactionLog(t, "tornfirst") })
+
+	insert := func(mux *http.ServeMux, point orb.Point) int {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tornfirst/insert", bytes.NewReader(body)))
+		return rr.Code
+	}
+
+	insert(mux, orb.Point{1, 1})
+	insert(mux, orb.Point{2, 2})
+	s.Stop()
+
+	if info, err := os.Stat("transaction_tornfirst.log"); err != nil || info.Size() != 0 {
+		t.Fatalf("Active segment is not empty after rotation: %v", err)
+	}
+
+	// The node was killed while writing the first record of the segment
+	file, err := os.OpenFile("transaction_tornfirst.log", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open transaction log: %v", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 0xde, 0xad, '{', '"'})
+	file.Close()
+
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "tornfirst", []string{}, true, opts...)
+	if s == nil {
+		t.Fatalf("Storage did not start after a torn first record")
+	}
+	t.Cleanup(s.Stop)
+
+	if lsn := s.Engine.VClock()["tornfirst"]; lsn != 2 {
+		t.Errorf("Unexpected LSN after recovery: got %v want %v", lsn, 2)
+	}
+	if code := insert(mux, orb.Point{3, 3}); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if lsn := s.Engine.VClock()["tornfirst"]; lsn != 3 {
+		t.Errorf("Unexpected LSN after write: got %v want %v", lsn, 3)
+	}
+}
+
+func TestGroupCommitInterval(t *testing.T) {
+	mux := http.NewServeMux()
+	// A missing interval falls back to the default one
+	s := storage.NewStorage(mux, "group", []string{}, true, engine.WithSync(engine.SyncGroup, 0))
+
+	t.Cleanup(func() { removeTransactionLog(t, "group") })
+	t.Cleanup(s.Stop)
+
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{1, 1}))
+	req := httptest.NewRequest(http.MethodPost, "/group/insert", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestLogSegments(t *testing.T) {
+	mux := http.NewServeMux()
+
+	// Every transaction goes to its own segment
+	opts := []engine.Option{engine.WithSegments(1, 0), engine.WithRetention(1, 0)}
+	s := storage.NewStorage(mux, "segments", []string{}, true, opts...)
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "segments")
+		if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+
+	for i := 1; i <= 3; i++ {
+		body, _ := json.Marshal(geojson.NewFeature(orb.Point{float64(i), float64(i)}))
+		req := httptest.NewRequest(http.MethodPost, "/segments/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	s.Stop()
+
+	segments, _ := filepath.Glob("transaction_segments.log.0*")
+	if len(segments) != 3 {
+		t.Fatalf("Unexpected segments: got %v want 3", segments)
+	}
+
+	// A restart replays all segments
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "segments", []string{}, true, opts...)
+	t.Cleanup(s.Stop)
+
+	if lsn := s.Engine.VClock()["segments"]; lsn != 3 {
+		t.Errorf("Unexpected LSN after restart: got %v want %v", lsn, 3)
+	}
+
+	// A replica catches up from the sealed segments
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/segments/replication"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(util.Transaction{Action: "sync", Name: "replica", VClock: map[string]uint64{"segments": 1}}); err != nil {
+		t.Fatalf("Failed to send sync: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lsns []uint64
+	for len(lsns) < 2 {
+		var tx util.Transaction
+		if err := conn.ReadJSON(&tx); err != nil {
+			t.Fatalf("Failed to read transaction: %v", err)
+		}
+		if tx.Action == "heartbeat" {
+			continue
+		}
+		lsns = append(lsns, tx.LSN)
+	}
+	if lsns[0] != 2 || lsns[1] != 3 {
+		t.Errorf("Unexpected transactions: got LSNs %v want [2 3]", lsns)
+	}
+
+	// Only one segment covered by the checkpoint is retained
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/segments/checkpoint", nil))
+
+	segments, _ = filepath.Glob("transaction_segments.log.0*")
+	if len(segments) != 1 || segments[0] != "transaction_segments.log.000003" {
+		t.Errorf("Unexpected segments after checkpoint: got %v", segments)
+	}
+}
+
+func TestCheckpointRestart(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "restart", []string{}, true)
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "restart")
+		if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+
+	for i := 1; i <= 3; i++ {
+		body, _ := json.Marshal(geojson.NewFeature(orb.Point{float64(i), float64(i)}))
+		req := httptest.NewRequest(http.MethodPost, "/restart/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A transaction of another origin is part of the checkpoint as well
+	feature := geojson.NewFeature(orb.Point{4, 4})
+	feature.ID = "remote"
+	s.Engine.CommandCh <- util.Command{Action: "replicate", Transaction: util.Transaction{Action: "insert", Name: "other", LSN: 7, Feature: feature}}
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/restart/checkpoint", nil))
+	s.Stop()
+
+	// The log is gone, so the restart depends on the checkpoint only
+	removeTransactionLog(t, "restart")
+
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "restart", []string{}, true)
+	t.Cleanup(s.Stop)
+
+	vclock := s.Engine.VClock()
+	if vclock["restart"] != 3 || vclock["other"] != 7 {
+		t.Errorf("Unexpected vclock after restart: got %v", vclock)
+	}
+
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+	features := (<-responseChan).(engine.Selection).Features
+
+	ids := make(map[string]bool)
+	for _, f := range features {
+		ids[fmt.Sprint(f.ID)] = true
+	}
+	if len(features) != 4 || !ids["restart-1"] || !ids["restart-2"] || !ids["restart-3"] || !ids["remote"] {
+		t.Errorf("Unexpected features after restart: got %v", ids)
+	}
+}
+
+func TestAutoCheckpoint(t *testing.T) {
+	mux := http.NewServeMux()
+
+	// Checkpoint after every three transactions
+	s := storage.NewStorage(mux, "auto", []string{}, true, engine.WithAutoCheckpoint(0, 3, 0))
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "auto")
+		if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+	t.Cleanup(s.Stop)
+
+	for i := 1; i <= 3; i++ {
+		body, _ := json.Marshal(geojson.NewFeature(orb.Point{float64(i), float64(i)}))
+		req := httptest.NewRequest(http.MethodPost, "/auto/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var status engine.CheckpointStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/auto/checkpoint/status", nil))
+		if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+		if !status.Running && status.VClock["auto"] == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Checkpoint did not finish: got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status.Written != 3 || status.Total != 3 || status.Duration == "" {
+		t.Errorf("Unexpected checkpoint status: got %+v", status)
+	}
+	if _, err := os.Stat(s.Engine.ChkFile); err != nil {
+		t.Errorf("Checkpoint file was not written: %v", err)
+	}
+}
+
+func TestDeltaCheckpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "delta", []string{}, true)
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "delta")
+		files, _ := filepath.Glob(s.Engine.ChkFile + "*")
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				t.Errorf("Failed to delete %v: %v", file, err)
+			}
+		}
+	})
+
+	insert := func(point orb.Point) {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/delta/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	checkpoint := func(target string) {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, target, nil))
+	}
+
+	insert(orb.Point{1, 1})
+	insert(orb.Point{2, 2})
+	checkpoint("/delta/checkpoint")
+
+	// The delta holds one new and one deleted feature
+	insert(orb.Point{3, 3})
+	deleted := geojson.NewFeature(nil)
+	deleted.ID = "delta-1"
+	responseChan := make(chan any, 1)
+	s.Engine.CommandCh <- util.Command{Action: "delete", Feature: deleted, Response: responseChan}
+	<-responseChan
+	checkpoint("/delta/checkpoint")
+
+	if status := s.Engine.CheckpointStatus(); !status.Delta || status.Total != 2 {
+		t.Errorf("Unexpected delta checkpoint: got %+v", status)
+	}
+	if _, err := os.Stat(s.Engine.ChkFile + ".delta.000001"); err != nil {
+		t.Fatalf("Delta checkpoint was not written: %v", err)
+	}
+	s.Stop()
+
+	// The restart loads the base and the delta only
+	removeTransactionLog(t, "delta")
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "delta", []string{}, true)
+	t.Cleanup(s.Stop)
+
+	if lsn := s.Engine.VClock()["delta"]; lsn != 4 {
+		t.Errorf("Unexpected LSN after restart: got %v want %v", lsn, 4)
+	}
+
+	selectAll := func() map[string]bool {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+		ids := make(map[string]bool)
+		for _, f := range (<-responseChan).(engine.Selection).Features {
+			ids[fmt.Sprint(f.ID)] = true
+		}
+		return ids
+	}
+	if ids := selectAll(); len(ids) != 2 || !ids["delta-2"] || !ids["delta-3"] {
+		t.Errorf("Unexpected features after restart: got %v", ids)
+	}
+
+	// Compaction folds the delta into a new base
+	checkpoint("/delta/checkpoint?compact=true")
+
+	if status := s.Engine.CheckpointStatus(); status.Delta || status.Total != 2 {
+		t.Errorf("Unexpected compacted checkpoint: got %+v", status)
+	}
+	if files, _ := filepath.Glob(s.Engine.ChkFile + ".delta.*"); len(files) != 0 {
+		t.Errorf("Deltas were not removed after compaction: got %v", files)
+	}
+}
+
+func TestRecordEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  engine.Option
+	}{
+		{"encjson", engine.WithEncoding(engine.FormatJSON, engine.CompressNone)},
+		{"encbinary", engine.WithEncoding(engine.FormatBinary, engine.CompressNone)},
+		{"enczstd", engine.WithEncoding(engine.FormatBinary, engine.CompressZstd)},
+		{"encsnappy", engine.WithEncoding(engine.FormatBinary, engine.CompressSnappy)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			s := storage.NewStorage(mux, tt.name, []string{}, true, tt.opt)
+
+			t.Cleanup(func() {
+				removeTransactionLog(t, tt.name)
+				if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+					t.Errorf("Failed to delete checkpoint: %v", err)
+				}
+			})
+
+			polygon := geojson.NewFeature(orb.Polygon{{{0, 0}, {2, 0}, {2, 2}, {0, 2}, {0, 0}}})
+			polygon.Properties["name"] = "square"
+			point := geojson.NewFeature(orb.Point{3, 3})
+
+			for _, feature := range []*geojson.Feature{polygon, point} {
+				body, _ := json.Marshal(feature)
+				req := httptest.NewRequest(http.MethodPost, "/"+tt.name+"/insert", bytes.NewReader(body))
+				mux.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+tt.name+"/checkpoint", nil))
+
+			// The point is in the log only, the polygon in the checkpoint
+			body, _ := json.Marshal(geojson.NewFeature(orb.Point{4, 4}))
+			req := httptest.NewRequest(http.MethodPost, "/"+tt.name+"/insert", bytes.NewReader(body))
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+			s.Stop()
+
+			// A restart reads the records in any format
+			mux = http.NewServeMux()
+			s = storage.NewStorage(mux, tt.name, []string{}, true)
+			t.Cleanup(s.Stop)
+
+			responseChan := make(chan any)
+			s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+			features := (<-responseChan).(engine.Selection).Features
+
+			if len(features) != 3 {
+				t.Fatalf("Unexpected features after restart: got %v want %v", len(features), 3)
+			}
+			for _, f := range features {
+				if f.Geometry.GeoJSONType() == "Polygon" && f.Properties["name"] != "square" {
+					t.Errorf("Properties were not restored: got %v", f.Properties)
+				}
+			}
+		})
+	}
+}
+
+func TestLegacyTransactionLog(t *testing.T) {
+	t.Cleanup(func() { removeTransactionLog(t, "legacy") })
+
+	// A log of JSON lines as written before records were framed, torn in
+	// the middle of its last line
+	legacy := `{"action":"insert","name":"legacy","lsn":1,"feature":{"id":1,"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]},"properties":null}}
+{"action":"insert","name":"legacy","lsn":2,"feature":{"id":2,"type":"Feature","geometry":{"type":"Point","coordinates":[2,2]},"properties":null}}
+{"action":"delete","name":"legacy","lsn":3,"feature":{"id":1,"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]},"properties":null}}
+{"action":"insert","name":"legacy","lsn":4,"feat`
+	if err := os.WriteFile("transaction_legacy.log", []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write transaction log: %v", err)
+	}
+
+	count := func(s *storage.Storage) int {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "legacy", []string{}, true)
+	if s.Engine == nil {
+		t.Fatalf("Engine did not start from a legacy log")
+	}
+	if n, lsn := count(s), s.Engine.VClock()["legacy"]; n != 1 || lsn != 3 {
+		t.Errorf("Unexpected state from legacy log: got %v features at LSN %v", n, lsn)
+	}
+
+	// The log is rewritten as framed records and appended to as usual
+	data, err := os.ReadFile("transaction_legacy.log")
+	if err != nil || len(data) == 0 || data[0] == '{' {
+		t.Fatalf("Legacy log was not converted: %v %q", err, data)
+	}
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{3, 3}))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/legacy/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: %v %v", rr.Code, rr.Body.String())
+	}
+	s.Stop()
+
+	s = storage.NewStorage(http.NewServeMux(), "legacy", []string{}, true)
+	t.Cleanup(s.Stop)
+	if n, lsn := count(s), s.Engine.VClock()["legacy"]; n != 2 || lsn != 4 {
+		t.Errorf("Unexpected state after restart: got %v features at LSN %v", n, lsn)
+	}
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "pitr", []string{}, true)
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "pitr")
+		files, _ := filepath.Glob(s.Engine.ChkFile + "*")
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				t.Errorf("Failed to delete %v: %v", file, err)
+			}
+		}
+	})
+
+	insert := func(point orb.Point) {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/pitr/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	selectAll := func() int {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	insert(orb.Point{1, 1})
+	insert(orb.Point{2, 2})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/pitr/checkpoint", nil))
+	insert(orb.Point{3, 3})
+	target := time.Now()
+
+	// Everything is deleted by mistake
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "drop", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+	<-responseChan
+	if n := selectAll(); n != 0 {
+		t.Fatalf("Unexpected features after drop: got %v want %v", n, 0)
+	}
+
+	dropped := s.Engine.VClock()["pitr"]
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/pitr/restore?time=bad", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for an invalid time: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/pitr/restore?time="+target.Format(time.RFC3339Nano), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %v %v", rr.Code, rr.Body.String())
+	}
+	if n := selectAll(); n != 3 {
+		t.Errorf("Unexpected features after restore: got %v want %v", n, 3)
+	}
+	// The LSNs of the discarded drop are not reused
+	if lsn := s.Engine.VClock()["pitr"]; lsn != dropped {
+		t.Errorf("Unexpected LSN after restore: got %v want %v", lsn, dropped)
+	}
+
+	// The log goes on from the restored state
+	insert(orb.Point{4, 4})
+	if n := selectAll(); n != 4 {
+		t.Errorf("Unexpected features after insert: got %v want %v", n, 4)
+	}
+	s.Stop()
+
+	// A restart can restore to a vclock as well
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "pitr", []string{}, true, engine.WithRecoveryTarget(engine.RecoveryTarget{VClock: map[string]uint64{"pitr": dropped}}))
+	t.Cleanup(s.Stop)
+
+	if n := selectAll(); n != 3 {
+		t.Errorf("Unexpected features after restart: got %v want %v", n, 3)
+	}
+}
+
+func TestRestoreReplication(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	leader := storage.NewStorage(mux, "rewind1", []string{host + "/rewind2"}, true)
+	follower := storage.NewStorage(mux, "rewind2", []string{host + "/rewind1"}, false)
+
+	t.Cleanup(func() {
+		for _, name := range []string{"rewind1", "rewind2"} {
+			removeTransactionLog(t, name)
+			files, _ := filepath.Glob("checkpoint_" + name + ".json*")
+			for _, file := range files {
+				os.RemoveAll(file)
+			}
+		}
+	})
+	t.Cleanup(leader.Stop)
+	t.Cleanup(follower.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for name, _ := follower.Leader(); name != "rewind1"; name, _ = follower.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not learn the leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	insert := func(point orb.Point) int {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/rewind1/insert?write_concern=all", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	count := func(s *storage.Storage, rect [2][2]float64) int {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: rect, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if code := insert(orb.Point{float64(i), float64(i)}); code != http.StatusOK {
+			t.Fatalf("Insert failed: got %v", code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/rewind1/restore?vclock=rewind1:1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %v %v", rr.Code, rr.Body.String())
+	}
+
+	// The write after the restore gets a new LSN, so the replica applies it
+	// and its ack confirms it
+	if code := insert(orb.Point{4, 4}); code != http.StatusOK {
+		t.Fatalf("Insert after restore failed: got %v", code)
+	}
+	if lsn := follower.Engine.VClock()["rewind1"]; lsn != 4 {
+		t.Errorf("Unexpected follower LSN: got %v want %v", lsn, 4)
+	}
+	if n := count(follower, [2][2]float64{{3.5, 3.5}, {4.5, 4.5}}); n != 1 {
+		t.Errorf("Write after restore is not on the follower: got %v features", n)
+	}
+}
+
+func TestRestoreArchiveFailure(t *testing.T) {
+	// The archive directory of a restore gets a name too long for the file
+	// system, while the log and its segments still fit
+	logFile := "transaction_" + strings.Repeat("r", 218) + ".log"
+	e := engine.NewEngine(context.Background(), logFile, "archive", true)
+	if e == nil {
+		t.Fatalf("Engine did not start")
+	}
+	t.Cleanup(func() {
+		files, _ := filepath.Glob(logFile + "*")
+		files = append(files, e.ChkFile)
+		for _, file := range files {
+			os.RemoveAll(file)
+		}
+	})
+
+	command := func(cmd util.Command) any {
+		responseChan := make(chan any, 1)
+		cmd.Response = responseChan
+		e.CommandCh <- cmd
+		return <-responseChan
+	}
+	count := func() int {
+		features := command(util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}})
+		return len(features.(engine.Selection).Features)
+	}
+	command(util.Command{Action: "insert", Feature: geojson.NewFeature(orb.Point{1, 1})})
+	command(util.Command{Action: "insert", Feature: geojson.NewFeature(orb.Point{2, 2})})
+
+	target := util.Transaction{VClock: map[string]uint64{"archive": 1}}
+	if _, ok := command(util.Command{Action: "restore", Transaction: target}).(error); !ok {
+		t.Fatalf("Restore did not fail")
+	}
+
+	// Memory and files still agree on the state before the restore
+	if n, lsn := count(), e.VClock()["archive"]; n != 2 || lsn != 2 {
+		t.Errorf("Failed restore changed the state: got %v features at LSN %v", n, lsn)
+	}
+	command(util.Command{Action: "insert", Feature: geojson.NewFeature(orb.Point{3, 3})})
+	e.Stop()
+
+	e = engine.NewEngine(context.Background(), logFile, "archive", true)
+	if e == nil {
+		t.Fatalf("Engine did not restart")
+	}
+	t.Cleanup(e.Stop)
+	if n, lsn := count(), e.VClock()["archive"]; n != 3 || lsn != 3 {
+		t.Errorf("Unexpected state after restart: got %v features at LSN %v", n, lsn)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "backup", []string{}, true)
+	t.Cleanup(s.Stop)
+
+	t.Cleanup(func() {
+		for _, name := range []string{"backup", "restored", "failed"} {
+			removeTransactionLog(t, name)
+			files, _ := filepath.Glob("checkpoint_" + name + ".json*")
+			for _, file := range files {
+				if err := os.Remove(file); err != nil {
+					t.Errorf("Failed to delete %v: %v", file, err)
+				}
+			}
+		}
+	})
+
+	insert := func(point orb.Point) {
+		body, _ := json.Marshal(geojson.NewFeature(point))
+		req := httptest.NewRequest(http.MethodPost, "/backup/insert", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The backup holds a checkpoint and the log after it
+	insert(orb.Point{1, 1})
+	insert(orb.Point{2, 2})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/backup/checkpoint", nil))
+	insert(orb.Point{3, 3})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/backup/backup", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Backup failed: %v", rr.Code)
+	}
+	archive := rr.Body.Bytes()
+
+	m, err := engine.VerifyBackup(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Backup does not verify: %v", err)
+	}
+	if m.Name != "backup" || m.VClock["backup"] != 3 {
+		t.Errorf("Unexpected backup manifest: got %+v", m)
+	}
+
+	// A corrupted or cut off archive is detected
+	corrupted := bytes.Clone(archive)
+	corrupted[1024] ^= 0xff
+	if _, err := engine.VerifyBackup(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("Corrupted backup verified")
+	}
+	if _, err := engine.VerifyBackup(bytes.NewReader(archive[:len(archive)/2])); err == nil {
+		t.Errorf("Truncated backup verified")
+	}
+
+	restore := func(mux *http.ServeMux, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(archive))
+		req.Header.Set("Content-Type", "application/x-tar")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Only an empty node takes a backup
+	if rr := restore(mux, "/backup/restore"); rr.Code != http.StatusConflict {
+		t.Errorf("Unexpected status for a node with data: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	restoredMux := http.NewServeMux()
+	restored := storage.NewStorage(restoredMux, "restored", []string{}, true)
+	t.Cleanup(restored.Stop)
+
+	if rr := restore(restoredMux, "/restored/restore"); rr.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %v %v", rr.Code, rr.Body.String())
+	}
+	if lsn := restored.Engine.VClock()["backup"]; lsn != 3 {
+		t.Errorf("Unexpected vclock after restore: got %v want %v", lsn, 3)
+	}
+
+	responseChan := make(chan any)
+	restored.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {5, 5}}, Response: responseChan}
+	if features := (<-responseChan).(engine.Selection).Features; len(features) != 3 {
+		t.Errorf("Unexpected features after restore: got %v want %v", len(features), 3)
+	}
+
+	// A directory in the way of the segment manifest fails the install, and
+	// the node goes on with its own files
+	failedMux := http.NewServeMux()
+	failed := storage.NewStorage(failedMux, "failed", []string{}, true)
+	if err := os.MkdirAll("transaction_failed.log.segments/blocked", 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if rr := restore(failedMux, "/failed/restore"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status for a failed install: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	if lsn := failed.Engine.VClock()["backup"]; lsn != 0 {
+		t.Errorf("Failed install loaded the backup: got LSN %v", lsn)
+	}
+	body, _ := json.Marshal(geojson.NewFeature(orb.Point{1, 1}))
+	rr = httptest.NewRecorder()
+	failedMux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/failed/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Write after a failed install: got %v %v", rr.Code, rr.Body.String())
+	}
+	failed.Stop()
+	os.RemoveAll("transaction_failed.log.segments")
+
+	failed = storage.NewStorage(http.NewServeMux(), "failed", []string{}, true)
+	t.Cleanup(failed.Stop)
+	vclock := failed.Engine.VClock()
+	if vclock["failed"] != 1 || vclock["backup"] != 0 {
+		t.Errorf("Unexpected vclock after restart: got %v", vclock)
+	}
+}
+
+func TestClientFeatureIDs(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "ids", []string{}, true)
+	t.Cleanup(s.Stop)
+	t.Cleanup(func() { removeTransactionLog(t, "ids") })
+
+	insert := func(id any) int {
+		feature := geojson.NewFeature(orb.Point{1, 1})
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/ids/insert", bytes.NewReader(body)))
+		return rr.Code
+	}
+
+	uuid := "0b8e2f4c-3a52-4c8e-9f0e-6a1d2c3b4a59"
+	if code := insert(uuid); code != http.StatusOK {
+		t.Fatalf("Insert failed: got %v", code)
+	}
+	if code := insert(42); code != http.StatusOK {
+		t.Fatalf("Insert failed: got %v", code)
+	}
+
+	// The same ID again is a conflict and is not logged
+	if code := insert(uuid); code != http.StatusConflict {
+		t.Errorf("Unexpected status for a duplicate ID: got %v want %v", code, http.StatusConflict)
+	}
+	if lsn := s.Engine.VClock()["ids"]; lsn != 2 {
+		t.Errorf("Unexpected LSN: got %v want %v", lsn, 2)
+	}
+
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {2, 2}}, Response: responseChan}
+	ids := make(map[string]bool)
+	for _, f := range (<-responseChan).(engine.Selection).Features {
+		ids[fmt.Sprint(f.ID)] = true
+	}
+	if len(ids) != 2 || !ids[uuid] || !ids["42"] {
+		t.Errorf("Client IDs were not kept: got %v", ids)
+	}
+}
+
+func TestReplaceMovesFeature(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "moves", []string{}, true)
+	t.Cleanup(s.Stop)
+	t.Cleanup(func() { removeTransactionLog(t, "moves") })
+
+	write := func(action string, id string, point orb.Point) int {
+		feature := geojson.NewFeature(point)
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/moves/"+action, bytes.NewReader(body)))
+		return rr.Code
+	}
+	count := func(rect [2][2]float64) int {
+		responseChan := make(chan any)
+		s.Engine.CommandCh <- util.Command{Action: "select", Rect: rect, Response: responseChan}
+		return len((<-responseChan).(engine.Selection).Features)
+	}
+
+	if code := write("insert", "a", orb.Point{1, 1}); code != http.StatusOK {
+		t.Fatalf("Insert failed: got %v", code)
+	}
+	if code := write("replace", "a", orb.Point{3, 3}); code != http.StatusOK {
+		t.Fatalf("Replace failed: got %v", code)
+	}
+
+	// The old bounds are gone from the rtree
+	if n := count([2][2]float64{{0, 0}, {2, 2}}); n != 0 {
+		t.Errorf("Replaced feature is still found at its old place: got %v", n)
+	}
+	if n := count([2][2]float64{{2, 2}, {4, 4}}); n != 1 {
+		t.Errorf("Replaced feature is not found at its new place: got %v", n)
+	}
+
+	if code := write("replace", "missing", orb.Point{1, 1}); code != http.StatusNotFound {
+		t.Errorf("Unexpected status for an unknown ID: got %v want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestReplaceAcrossShards(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "westward", []string{}, true)
+	s2 := storage.NewStorage(mux, "eastward", []string{}, true)
+	r := NewRouter(mux, [][]string{{"westward"}, {"eastward"}})
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "westward")
+		removeTransactionLog(t, "eastward")
+	})
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	write := func(action string, id string, geometry orb.Geometry, ifMatch string) *httptest.ResponseRecorder {
+		feature := geojson.NewFeature(geometry)
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		req := httptest.NewRequest(http.MethodPost, "/"+action, bytes.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(node string, id string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+node+"/get?id="+id, nil))
+		return rr.Code
+	}
+
+	// A point moved to the other side of the map
+	if rr := write("insert", "moving", orb.Point{-100, 0}, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: got %v", rr.Code)
+	}
+	if rr := write("replace", "moving", orb.Point{100, 0}, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Move failed: got %v %s", rr.Code, rr.Body.String())
+	}
+	if code := get("westward", "moving"); code != http.StatusNotFound {
+		t.Errorf("Moved feature is left on its old shard: got %v", code)
+	}
+	if code := get("eastward", "moving"); code != http.StatusOK {
+		t.Errorf("Moved feature is not on its new shard: got %v", code)
+	}
+
+	// A line crossing the border shrunk to one side of it
+	if rr := write("insert", "shrinking", orb.LineString{{-5, 0}, {5, 0}}, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: got %v", rr.Code)
+	}
+	if code := get("westward", "shrinking"); code != http.StatusOK {
+		t.Fatalf("Crossing feature is not on both shards: got %v", code)
+	}
+
+	// A version mismatch on one shard changes neither
+	if rr := write("replace", "shrinking", orb.LineString{{1, 0}, {5, 0}}, `"eastward:999"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected status for a stale version: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+	if code := get("westward", "shrinking"); code != http.StatusOK {
+		t.Errorf("Rejected replace removed a copy: got %v", code)
+	}
+
+	rr := write("replace", "shrinking", orb.LineString{{1, 0}, {5, 0}}, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Shrink failed: got %v %s", rr.Code, rr.Body.String())
+	}
+	if etag := rr.Header().Get("ETag"); strings.Contains(etag, "+") {
+		t.Errorf("Unexpected ETag for a feature on one shard: %v", etag)
+	}
+	if code := get("westward", "shrinking"); code != http.StatusNotFound {
+		t.Errorf("Shrunk feature is left on the other shard: got %v", code)
+	}
+	if code := get("eastward", "shrinking"); code != http.StatusOK {
+		t.Errorf("Shrunk feature is not on its owner: got %v", code)
+	}
+
+	if rr := write("replace", "missing", orb.Point{1, 1}, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status for an unknown ID: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestFeatureVersions(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "etag", []string{}, true)
+	NewRouter(mux, [][]string{{"etag"}})
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "etag")
+		if err := os.Remove(s.Engine.ChkFile); err != nil && !os.IsNotExist(err) {
+			t.Errorf("Failed to delete checkpoint: %v", err)
+		}
+	})
+
+	write := func(action string, ifMatch string, point orb.Point) *httptest.ResponseRecorder {
+		feature := geojson.NewFeature(point)
+		feature.ID = "f"
+		body, _ := json.Marshal(feature)
+		req := httptest.NewRequest(http.MethodPost, "/"+action, bytes.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func() string {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/get?id=f", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Get failed: %v %v", rr.Code, rr.Body.String())
+		}
+		return rr.Header().Get("ETag")
+	}
+
+	rr := write("insert", "", orb.Point{1, 1})
+	first := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || first != `"etag:1"` {
+		t.Fatalf("Unexpected insert: got %v %q", rr.Code, first)
+	}
+	if etag := get(); etag != first {
+		t.Errorf("Unexpected ETag: got %v want %v", etag, first)
+	}
+
+	rr = write("replace", first, orb.Point{2, 2})
+	second := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || second != `"etag:2"` {
+		t.Fatalf("Unexpected replace: got %v %q", rr.Code, second)
+	}
+
+	// Someone else changed the feature since the first version was read
+	if rr := write("replace", first, orb.Point{3, 3}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected status for a stale replace: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	// Select returns the versions as a member of the collection
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/select?rect=0,0,5,5", nil))
+	result, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if versions, _ := result.ExtraMembers["versions"].(map[string]any); versions["f"] != "etag:2" {
+		t.Errorf("Unexpected versions: got %v", result.ExtraMembers["versions"])
+	}
+
+	// The version survives a restart from the checkpoint
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/etag/checkpoint", nil))
+	s.Stop()
+	removeTransactionLog(t, "etag")
+
+	mux = http.NewServeMux()
+	s = storage.NewStorage(mux, "etag", []string{}, true)
+	NewRouter(mux, [][]string{{"etag"}})
+	t.Cleanup(s.Stop)
+
+	if etag := get(); etag != second {
+		t.Errorf("Unexpected ETag after restart: got %v want %v", etag, second)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/delete?id=f", nil)
+	req.Header.Set("If-Match", first)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected status for a stale delete: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/delete?id=f", nil)
+	req.Header.Set("If-Match", second)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Delete failed: got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSpatialPredicates(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "west", []string{}, true)
+	s2 := storage.NewStorage(mux, "east", []string{}, true)
+	r := NewRouter(mux, [][]string{{"west"}, {"east"}})
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "west")
+		removeTransactionLog(t, "east")
+	})
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	features := map[string]orb.Geometry{
+		// The bounding box of the diagonal overlaps the district, the line
+		// itself passes it by
+		"diagonal": orb.LineString{{0, 10}, {10, 0}},
+		"inside":   orb.Point{1, 1},
+		"crossing": orb.Polygon{{{3, 3}, {6, 3}, {6, 6}, {3, 6}, {3, 3}}},
+		"far":      orb.Point{-50, 50},
+		"holed": orb.Polygon{
+			{{-10, -10}, {10, -10}, {10, 10}, {-10, 10}, {-10, -10}},
+			{{-1, -1}, {5, -1}, {5, 5}, {-1, 5}, {-1, -1}},
+		},
+	}
+	for id, geometry := range features {
+		feature := geojson.NewFeature(geometry)
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Insert of %s failed: %v %v", id, rr.Code, rr.Body.String())
+		}
+	}
+
+	district := `{"type":"Polygon","coordinates":[[[0,0],[4,0],[4,4],[0,4],[0,0]]]}`
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []string
+	}{
+		{"rect only", url.Values{"rect": {"0,0,4,4"}}, []string{"crossing", "diagonal", "holed", "inside"}},
+		{"intersects rect", url.Values{"rect": {"0,0,4,4"}, "predicate": {"intersects"}}, []string{"crossing", "inside"}},
+		{"intersects", url.Values{"geometry": {district}}, []string{"crossing", "inside"}},
+		{"within", url.Values{"geometry": {district}, "predicate": {"within"}}, []string{"inside"}},
+		{"contains", url.Values{"geometry": {`{"type":"Point","coordinates":[5.5,4]}`}, "predicate": {"contains"}}, []string{"crossing", "holed"}},
+		{"contains in hole", url.Values{"geometry": {`{"type":"Point","coordinates":[2,2]}`}, "predicate": {"contains"}}, nil},
+		{"disjoint", url.Values{"geometry": {district}, "predicate": {"disjoint"}}, []string{"diagonal", "far", "holed"}},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/select?"+tt.query.Encode(), nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %v: %v", tt.name, rr.Code, rr.Body.String())
+		}
+		result, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.name, err)
+		}
+
+		var got []string
+		for _, feature := range result.Features {
+			got = append(got, fmt.Sprint(feature.ID))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"rect=0,0,4,4&predicate=overlaps", "geometry=%7B%22type%22%3A%22Nothing%22%7D"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/select?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %s: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNearestSearch(t *testing.T) {
+	mux := http.NewServeMux()
+	s1 := storage.NewStorage(mux, "west", []string{}, true)
+	s2 := storage.NewStorage(mux, "east", []string{}, true)
+	r := NewRouter(mux, [][]string{{"west"}, {"east"}})
+
+	t.Cleanup(func() {
+		removeTransactionLog(t, "west")
+		removeTransactionLog(t, "east")
+	})
+	t.Cleanup(r.Stop)
+	t.Cleanup(s1.Stop)
+	t.Cleanup(s2.Stop)
+
+	// Around a point on the equator, 0.001 degrees are 111 meters
+	features := map[string]orb.Geometry{
+		"square": orb.Polygon{{{0.0005, -0.0005}, {0.0015, -0.0005}, {0.0015, 0.0005}, {0.0005, 0.0005}, {0.0005, -0.0005}}},
+		"east":   orb.Point{0.002, 0},
+		"west":   orb.Point{-0.003, 0},
+		"road":   orb.LineString{{0, 0.005}, {0.005, 0.005}},
+		"far":    orb.Point{10, 10},
+	}
+	for id, geometry := range features {
+		feature := geojson.NewFeature(geometry)
+		feature.ID = id
+		body, _ := json.Marshal(feature)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Insert of %s failed: %v %v", id, rr.Code, rr.Body.String())
+		}
+	}
+
+	tests := []struct {
+		query     string
+		want      []string
+		distances []float64
+	}{
+		{"/nearest?point=0.001,0&k=4", []string{"square", "east", "west", "road"}, []float64{0, 111.3, 445.3, 556.6}},
+		{"/nearest?point=0.001,0&k=2", []string{"square", "east"}, []float64{0, 111.3}},
+		{"/within-distance?point=0.001,0&meters=500", []string{"square", "east", "west"}, []float64{0, 111.3, 445.3}},
+		{"/within-distance?point=0.001,0&meters=50", []string{"square"}, []float64{0}},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %v: %v", tt.query, rr.Code, rr.Body.String())
+		}
+		result, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.query, err)
+		}
+
+		var got []string
+		for _, feature := range result.Features {
+			got = append(got, fmt.Sprint(feature.ID))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+			continue
+		}
+
+		distances, _ := result.ExtraMembers["distances"].(map[string]any)
+		for i, id := range tt.want {
+			if d, _ := distances[id].(float64); math.Abs(d-tt.distances[i]) > 1 {
+				t.Errorf("%s: unexpected distance of %s: got %v want %v", tt.query, id, d, tt.distances[i])
+			}
+		}
+	}
+
+	for _, query := range []string{"/nearest?k=3", "/nearest?point=0,0&k=0", "/nearest?point=200,0", "/within-distance?point=0,0"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %s: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestProjections(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "crs", []string{}, true)
+	r := NewRouter(mux, [][]string{{"crs"}})
+
+	t.Cleanup(func() { removeTransactionLog(t, "crs") })
+	t.Cleanup(r.Stop)
+	t.Cleanup(s.Stop)
+
+	send := func(method string, target string, header http.Header, feature *geojson.Feature) *httptest.ResponseRecorder {
+		var body []byte
+		if feature != nil {
+			body, _ = json.Marshal(feature)
+		}
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	point := func(id string, p orb.Point) *geojson.Feature {
+		feature := geojson.NewFeature(p)
+		feature.ID = id
+		return feature
+	}
+
+	// The web client writes web mercator, the mobile client lon/lat
+	if rr := send(http.MethodPost, "/insert?proj=EPSG:3857", nil, point("web", orb.Point{3374339, 8388441})); rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send(http.MethodPost, "/insert", nil, point("mobile", orb.Point{30.32, 59.94})); rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: %v %v", rr.Code, rr.Body.String())
+	}
+	header := http.Header{"Content-Crs": {"EPSG:3857"}}
+	if rr := send(http.MethodPost, "/insert", header, point("header", orb.Point{3375000, 8389000})); rr.Code != http.StatusOK {
+		t.Fatalf("Insert failed: %v %v", rr.Code, rr.Body.String())
+	}
+
+	// Everything is stored as lon/lat
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{30, 59}, {31, 61}}, Response: responseChan}
+	if features := (<-responseChan).(engine.Selection).Features; len(features) != 3 {
+		t.Fatalf("Unexpected features in lon/lat: got %v want 3", len(features))
+	}
+
+	coordinates := func(rr *httptest.ResponseRecorder) map[string]orb.Point {
+		result, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to decode response: %v %v", err, rr.Body.String())
+		}
+		points := make(map[string]orb.Point)
+		for _, feature := range result.Features {
+			points[fmt.Sprint(feature.ID)] = feature.Geometry.(orb.Point)
+		}
+		return points
+	}
+	near := func(a, b orb.Point, tolerance float64) bool {
+		return math.Abs(a[0]-b[0]) <= tolerance && math.Abs(a[1]-b[1]) <= tolerance
+	}
+
+	rr := send(http.MethodGet, "/select?rect=3300000,8300000,3400000,8400000&proj=EPSG:3857", nil, nil)
+	if got := rr.Header().Get("Content-Crs"); got != "EPSG:3857" {
+		t.Errorf("Unexpected Content-Crs: got %q", got)
+	}
+	points := coordinates(rr)
+	if len(points) != 3 || !near(points["web"], orb.Point{3374339, 8388441}, 1e-6) {
+		t.Errorf("Unexpected web mercator features: got %v", points)
+	}
+
+	points = coordinates(send(http.MethodGet, "/select?rect=30,59,31,61", nil, nil))
+	if len(points) != 3 || !near(points["web"], orb.Point{30.3122, 59.9492}, 1e-4) || points["mobile"] != (orb.Point{30.32, 59.94}) {
+		t.Errorf("Unexpected lon/lat features: got %v", points)
+	}
+
+	// Accept-Crs asks for another CRS than the rect is in
+	header = http.Header{"Accept-Crs": {"EPSG:4326"}}
+	points = coordinates(send(http.MethodGet, "/select?rect=3300000,8300000,3400000,8400000&proj=EPSG:3857", header, nil))
+	if len(points) != 3 || !near(points["header"], orb.Point{30.3181, 59.9517}, 1e-4) {
+		t.Errorf("Unexpected features for Accept-Crs: got %v", points)
+	}
+
+	rr = send(http.MethodGet, "/get?id=mobile", http.Header{"Accept-Crs": {"EPSG:3857"}}, nil)
+	feature, err := geojson.UnmarshalFeature(rr.Body.Bytes())
+	if err != nil || !near(feature.Geometry.(orb.Point), orb.Point{3375207, 8386392}, 1) {
+		t.Errorf("Unexpected feature for get: %v %v", rr.Code, rr.Body.String())
+	}
+
+	tests := []struct {
+		method string
+		target string
+		header http.Header
+		want   int
+	}{
+		{http.MethodGet, "/select?rect=0,0,1,1&proj=EPSG:27700", nil, http.StatusBadRequest},
+		{http.MethodGet, "/select?rect=0,0,1,1", http.Header{"Accept-Crs": {"EPSG:27700"}}, http.StatusNotAcceptable},
+		{http.MethodPost, "/insert", http.Header{"Content-Crs": {"EPSG:27700"}}, http.StatusBadRequest},
+		{http.MethodPost, "/crs/insert?proj=EPSG:27700", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr := send(tt.method, tt.target, tt.header, point("rejected", orb.Point{1, 1}))
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: got %v want %v", tt.method, tt.target, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestInputValidation(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "valid", []string{}, true)
+	r := NewRouter(mux, [][]string{{"valid"}})
+
+	t.Cleanup(func() { removeTransactionLog(t, "valid") })
+	t.Cleanup(r.Stop)
+	t.Cleanup(s.Stop)
+
+	send := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	fields := func(rr *httptest.ResponseRecorder) []string {
+		var result struct{ Errors []util.FieldError }
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to decode errors: %v %v", err, rr.Body.String())
+		}
+		var fields []string
+		for _, err := range result.Errors {
+			fields = append(fields, err.Field)
+		}
+		return fields
+	}
+
+	for _, target := range []string{"/select?rect=a,b,c,d", "/select?rect=10,0,0,10", "/valid/select?rect=0,0,10"} {
+		rr := send(http.MethodGet, target, "")
+		if rr.Code != http.StatusBadRequest || !slices.Equal(fields(rr), []string{"rect"}) {
+			t.Errorf("Unexpected response to %s: %v %v", target, rr.Code, rr.Body.String())
+		}
+	}
+	rr := send(http.MethodGet, "/nearest?point=0,0&k=0", "")
+	if rr.Code != http.StatusBadRequest || !slices.Equal(fields(rr), []string{"k"}) {
+		t.Errorf("Unexpected response to nearest: %v %v", rr.Code, rr.Body.String())
+	}
+
+	// An unclosed ring in clockwise order is rejected, or repaired on demand
+	unclosed := `{"type":"Feature","id":"square","geometry":{"type":"Polygon","coordinates":[[[0,0],[0,1],[1,1],[1,0]]]},"properties":{}}`
+	rr = send(http.MethodPost, "/insert", unclosed)
+	if rr.Code != http.StatusBadRequest || !slices.Equal(fields(rr), []string{"geometry.coordinates[0]"}) {
+		t.Errorf("Unexpected response to unclosed ring: %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = send(http.MethodPost, "/insert?repair=true", unclosed); rr.Code != http.StatusOK {
+		t.Fatalf("Repaired insert failed: %v %v", rr.Code, rr.Body.String())
+	}
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "select", Rect: [2][2]float64{{0, 0}, {1, 1}}, Response: responseChan}
+	features := (<-responseChan).(engine.Selection).Features
+	if len(features) != 1 {
+		t.Fatalf("Unexpected features: got %v want 1", len(features))
+	}
+	if ring := features[0].Geometry.(orb.Polygon)[0]; !ring.Closed() || ring.Orientation() != orb.CCW {
+		t.Errorf("Ring is not repaired: got %v", ring)
+	}
+
+	invalid := map[string]string{
+		"bow tie":    `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,1],[1,0],[0,1],[0,0]]]},"properties":{}}`,
+		"off map":    `{"type":"Feature","geometry":{"type":"Point","coordinates":[200,0]},"properties":{}}`,
+		"object id":  `{"type":"Feature","id":{"a":1},"geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}`,
+		"short line": `{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0,0]]},"properties":{}}`,
+		"properties": `{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{"a":"` + strings.Repeat("a", util.MaxPropertiesSize) + `"}}`,
+	}
+	for name, body := range invalid {
+		for _, target := range []string{"/insert", "/valid/insert"} {
+			if rr := send(http.MethodPost, target, body); rr.Code != http.StatusBadRequest || len(fields(rr)) != 1 {
+				t.Errorf("Unexpected response to %s at %s: %v %v", name, target, rr.Code, rr.Body.String())
+			}
+		}
+	}
+
+	large := `{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{"a":"` + strings.Repeat("a", util.MaxBodySize) + `"}}`
+	if rr := send(http.MethodPost, "/insert", large); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected response to large body: %v", rr.Code)
+	}
+}
+
+func TestAttributeFilter(t *testing.T) {
+	mux := http.NewServeMux()
+	s := storage.NewStorage(mux, "filter", []string{}, true)
+	r := NewRouter(mux, [][]string{{"filter"}})
+
+	t.Cleanup(func() { removeTransactionLog(t, "filter") })
+	t.Cleanup(r.Stop)
+	t.Cleanup(s.Stop)
+
+	places := []geojson.Properties{
+		{"name": "Café Pushkin", "category": "cafe", "rating": 4.5, "open": true},
+		{"name": "Coffee Corner", "category": "cafe", "rating": 3},
+		{"name": "Old Pub", "category": "pub", "rating": 4, "opening hours": "24/7"},
+		{"name": "Corner Bar", "category": "bar"},
+	}
+	for i, properties := range places {
+		feature := geojson.NewFeature(orb.Point{float64(i), float64(i)})
+		feature.ID = properties["name"]
+		feature.Properties = properties
+		body, _ := json.Marshal(feature)
+		req := httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Insert failed: %v %v", rr.Code, rr.Body.String())
+		}
+	}
+	// Far away, but a cafe with a high rating
+	far := geojson.NewFeature(orb.Point{100, 50})
+	far.Properties = geojson.Properties{"category": "cafe", "rating": 5}
+	body, _ := json.Marshal(far)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/insert", bytes.NewReader(body)))
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"category = 'cafe' AND rating >= 4", []string{"Café Pushkin"}},
+		{"NOT rating >= 4", []string{"Coffee Corner"}},
+		{"name like '%corner%' OR name LIKE 'Caf_ %'", []string{"Café Pushkin"}},
+		{"name LIKE '%Corner%'", []string{"Coffee Corner", "Corner Bar"}},
+		{"category IN ('bar', 'pub') AND NOT (rating < 4)", []string{"Old Pub"}},
+		{"rating BETWEEN 3 AND 4", []string{"Coffee Corner", "Old Pub"}},
+		{"rating IS NULL", []string{"Corner Bar"}},
+		{"open = TRUE OR \"opening hours\" = '24/7'", []string{"Café Pushkin", "Old Pub"}},
+		{"category <> 'cafe'", []string{"Corner Bar", "Old Pub"}},
+		{"rating = '4'", nil},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/select", "/filter/select"} {
+			target := path + "?" + url.Values{"rect": {"-1,-1,10,10"}, "filter": {tt.filter}}.Encode()
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+			result, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+			if err != nil {
+				t.Fatalf("Failed to decode response to %s: %v %v", tt.filter, err, rr.Body.String())
+			}
+			var got []string
+			for _, feature := range result.Features {
+				got = append(got, fmt.Sprint(feature.ID))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Unexpected features at %s for %s: got %v want %v", path, tt.filter, got, tt.want)
+			}
+		}
+	}
+
+	for _, filter := range []string{"rating >=", "category = 'cafe", "rating > 4 AND", "(rating > 4", "rating ~ 4"} {
+		target := "/select?" + url.Values{"rect": {"-1,-1,10,10"}, "filter": {filter}}.Encode()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"field":"filter"`) {
+			t.Errorf("Unexpected response to %q: %v %v", filter, rr.Code, rr.Body.String())
+		}
+	}
+}
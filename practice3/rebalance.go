@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb"
+	"log/slog"
+	"math"
+	"net/http"
+	"practice3/util"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sector is an entry of the routing table.
+type sector struct {
+	bound orb.Bound
+	shard *Shard
+}
+
+// migration moves the features of a region from one shard to another. Writes
+// to the region made while the data is copied are recorded and replayed on
+// the target shard before the routing table is switched.
+type migration struct {
+	bound  orb.Bound
+	source *Shard
+	target *Shard
+	mu     sync.Mutex
+	writes []pendingWrite
+}
+
+type pendingWrite struct {
+	path string
+	body []byte
+}
+
+func (m *migration) record(path string, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes = append(m.writes, pendingWrite{path: path, body: body})
+}
+
+func (m *migration) take() []pendingWrite {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writes := m.writes
+	m.writes = nil
+	return writes
+}
+
+// handleRebalance splits a sector or merges several sectors into one and
+// moves their data to the target shard.
+//
+//	POST /rebalance?action=split&point=x,y&target=node
+//	POST /rebalance?action=merge&rect=minx,miny,maxx,maxy&target=node
+func (r *Router) handleRebalance(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.rebalancing.TryLock() {
+		http.Error(w, "Rebalancing is already in progress", http.StatusConflict)
+		return
+	}
+	defer r.rebalancing.Unlock()
+
+	query := req.URL.Query()
+	target := r.shardByNode(query.Get("target"))
+	if target == nil {
+		http.Error(w, "Invalid target specified", http.StatusBadRequest)
+		return
+	}
+
+	var before, after []sector
+	var err error
+	switch query.Get("action") {
+	case "split":
+		before, after, err = r.planSplit(query.Get("point"), target)
+	case "merge":
+		before, after, err = r.planMerge(query.Get("rect"), target)
+	default:
+		err = errors.New("invalid action specified")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.rebalance(before, after); err != nil {
+		slog.Error("Rebalancing failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// planSplit splits the sector containing the point in two halves along its
+// longer side. The second half is given to the target shard.
+func (r *Router) planSplit(pointStr string, target *Shard) ([]sector, []sector, error) {
+	point := util.ParsePoint(pointStr)
+	if point == nil {
+		return nil, nil, errors.New("invalid point parameter")
+	}
+
+	sectors := r.sectors(orb.Bound{Min: *point, Max: *point})
+	if len(sectors) == 0 {
+		return nil, nil, errors.New("point is outside of the map")
+	}
+
+	s := sectors[0]
+	first, second := s.bound, s.bound
+	if s.bound.Max[0]-s.bound.Min[0] >= s.bound.Max[1]-s.bound.Min[1] {
+		mid := (s.bound.Min[0] + s.bound.Max[0]) / 2
+		first.Max[0], second.Min[0] = mid, mid
+	} else {
+		mid := (s.bound.Min[1] + s.bound.Max[1]) / 2
+		first.Max[1], second.Min[1] = mid, mid
+	}
+
+	return []sector{s}, []sector{{bound: first, shard: s.shard}, {bound: second, shard: target}}, nil
+}
+
+// planMerge merges all sectors inside the rect into one sector owned by the
+// target shard. The sectors must cover the rect exactly.
+func (r *Router) planMerge(rectStr string, target *Shard) ([]sector, []sector, error) {
+	rect := util.ParseRect(rectStr)
+	if rect == nil {
+		return nil, nil, errors.New("invalid rect parameter")
+	}
+	bound := orb.Bound{Min: rect[0], Max: rect[1]}
+
+	var before []sector
+	var area float64
+	for _, s := range r.sectors(bound) {
+		if bound.Contains(s.bound.Min) && bound.Contains(s.bound.Max) {
+			before = append(before, s)
+			area += boundArea(s.bound)
+		}
+	}
+
+	if len(before) < 2 || math.Abs(area-boundArea(bound)) > 1e-9*boundArea(bound) {
+		return nil, nil, errors.New("rect must be covered exactly by two or more sectors")
+	}
+
+	return before, []sector{{bound: bound, shard: target}}, nil
+}
+
+// rebalance replaces the sectors before with the sectors after. Every region
+// which changes its shard is copied first, then the writes made during the
+// copy are replayed and the routing table is switched. Reads and writes keep
+// going to the old shards until the switch.
+func (r *Router) rebalance(before, after []sector) error {
+	var migrations []*migration
+	for _, b := range before {
+		for _, a := range after {
+			if b.shard == a.shard {
+				continue
+			}
+			if region, ok := intersection(b.bound, a.bound); ok {
+				migrations = append(migrations, &migration{bound: region, source: b.shard, target: a.shard})
+			}
+		}
+	}
+
+	// Start recording writes before the data is read
+	r.mu.Lock()
+	r.migrations = migrations
+	r.mu.Unlock()
+
+	abort := func(err error) error {
+		r.mu.Lock()
+		r.migrations = nil
+		r.mu.Unlock()
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := r.copyRegion(m); err != nil {
+			return abort(err)
+		}
+	}
+
+	// Catch up with the writes made during the copy
+	for _, m := range migrations {
+		if err := r.replay(m); err != nil {
+			return abort(err)
+		}
+	}
+
+	// No writes are in flight while the lock is held, so the last ones are
+	// replayed and the table is switched atomically
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.migrations = nil
+	for _, m := range migrations {
+		if err := r.replay(m); err != nil {
+			return err
+		}
+	}
+
+	table := r.table.Copy()
+	for _, s := range before {
+		table.Delete(s.bound.Min, s.bound.Max, s.shard)
+	}
+	for _, s := range after {
+		table.Insert(s.bound.Min, s.bound.Max, s.shard)
+	}
+	r.table = table
+
+	slog.Info("Routing table switched", "sectors", r.table.Len())
+
+	// The moved features are no longer served by the source shards
+	for _, m := range migrations {
+		resp := r.write(m.source, http.MethodPost, "/drop?rect="+formatBound(m.bound), nil, nil)
+		if resp.code != http.StatusOK {
+			slog.Error("Failed to drop moved features", "shard", m.source.leader(), "error", resp.body.String())
+		}
+	}
+
+	return nil
+}
+
+// copyRegion copies the features of the region owned by the source shard to
+// the target shard.
+func (r *Router) copyRegion(m *migration) error {
+	result, err := r.query(m.source, "/select", "rect="+formatBound(m.bound))
+	if err != nil {
+		return fmt.Errorf("failed to read from shard %s: %w", m.source.leader(), err)
+	}
+
+	copied := 0
+	for _, feature := range result.Features {
+		// Skip copies left behind by an earlier rebalancing
+		r.mu.RLock()
+		owned := feature.Geometry != nil && r.owns(m.source, feature.Geometry.Bound())
+		r.mu.RUnlock()
+		if !owned {
+			continue
+		}
+
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			return err
+		}
+
+		resp := r.write(m.target, http.MethodPost, "/insert", body, nil)
+		if resp.code == http.StatusConflict {
+			// A copy left behind by an earlier rebalancing may be outdated
+			resp = r.write(m.target, http.MethodPost, "/replace", body, nil)
+		}
+		if resp.code >= http.StatusBadRequest {
+			return fmt.Errorf("failed to write to shard %s: %s", m.target.leader(), resp.body.String())
+		}
+		copied++
+	}
+
+	slog.Info("Region copied", "rect", formatBound(m.bound), "source", m.source.leader(), "target", m.target.leader(), "features", copied)
+	return nil
+}
+
+// replay applies the recorded writes to the target shard.
+func (r *Router) replay(m *migration) error {
+	for _, write := range m.take() {
+		resp := r.write(m.target, http.MethodPost, write.path, write.body, nil)
+		if resp.code == http.StatusConflict && write.path == "/insert" {
+			// The copy has the feature already
+			resp = r.write(m.target, http.MethodPost, "/replace", write.body, nil)
+		}
+		if resp.code == http.StatusNotFound && strings.HasPrefix(write.path, "/delete") {
+			// The feature was deleted before it was copied
+			continue
+		}
+		if resp.code >= http.StatusBadRequest {
+			return fmt.Errorf("failed to replay %s on shard %s: %s", write.path, m.target.leader(), resp.body.String())
+		}
+	}
+	return nil
+}
+
+// sectors returns the sectors which intersect the bound.
+func (r *Router) sectors(bound orb.Bound) []sector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sectors []sector
+	r.table.Search(bound.Min, bound.Max, func(min, max [2]float64, shard *Shard) bool {
+		sectors = append(sectors, sector{bound: orb.Bound{Min: min, Max: max}, shard: shard})
+		return true
+	})
+	return sectors
+}
+
+// shardByNode returns the shard which has the node in its replicaset.
+func (r *Router) shardByNode(node string) *Shard {
+	for _, shard := range r.shards {
+		for _, n := range shard.replicaset {
+			if n == node {
+				return shard
+			}
+		}
+	}
+	return nil
+}
+
+// intersection returns the common part of two bounds if it has an area.
+func intersection(a, b orb.Bound) (orb.Bound, bool) {
+	result := orb.Bound{
+		Min: orb.Point{math.Max(a.Min[0], b.Min[0]), math.Max(a.Min[1], b.Min[1])},
+		Max: orb.Point{math.Min(a.Max[0], b.Max[0]), math.Min(a.Max[1], b.Max[1])},
+	}
+	return result, result.Min[0] < result.Max[0] && result.Min[1] < result.Max[1]
+}
+
+func boundArea(b orb.Bound) float64 {
+	return (b.Max[0] - b.Min[0]) * (b.Max[1] - b.Min[1])
+}
+
+func formatBound(b orb.Bound) string {
+	return strconv.FormatFloat(b.Min[0], 'f', -1, 64) + "," +
+		strconv.FormatFloat(b.Min[1], 'f', -1, 64) + "," +
+		strconv.FormatFloat(b.Max[0], 'f', -1, 64) + "," +
+		strconv.FormatFloat(b.Max[1], 'f', -1, 64)
+}
@@ -1,25 +1,91 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"github.com/tidwall/rtree"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"practice3/util"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// mapBounds is the map extent in the canonical CRS (EPSG:4326) that is
+// split into sectors.
+var mapBounds = orb.Bound{
+	Min: orb.Point{-180, -90},
+	Max: orb.Point{180, 90},
+}
+
+// Shard is a replicaset of Storage nodes which owns one or more sectors.
+type Shard struct {
+	mu         sync.Mutex
+	leaderAddr string
+	replicaset []string
+}
+
+func (s *Shard) leader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaderAddr
+}
+
+// setLeader remembers the new leader if it belongs to the replicaset.
+func (s *Shard) setLeader(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, node := range s.replicaset {
+		if node == addr && addr != s.leaderAddr {
+			slog.Info("Shard leader changed", "old", s.leaderAddr, "new", addr)
+			s.leaderAddr = addr
+		}
+	}
+}
+
 type Router struct {
-	mux   *http.ServeMux
-	nodes [][]string
+	mux         *http.ServeMux
+	nodes       [][]string
+	shards      []*Shard
+	mu          sync.RWMutex          // Guards table and migrations
+	table       *rtree.RTreeG[*Shard] // Routing table: sector -> shard
+	migrations  []*migration
+	rebalancing sync.Mutex
 }
 
+// NewRouter creates a Router for the given replicasets. Every replicaset is
+// one shard, the first node of a replicaset is its leader.
 func NewRouter(mux *http.ServeMux, nodes [][]string) *Router {
-	r := &Router{mux: mux, nodes: nodes}
+	r := &Router{mux: mux, nodes: nodes, table: &rtree.RTreeG[*Shard]{}}
+	for _, replicaset := range nodes {
+		r.shards = append(r.shards, &Shard{leaderAddr: replicaset[0], replicaset: replicaset})
+	}
+	r.splitSectors()
+
 	mux.Handle("/", http.FileServer(http.Dir("../front/dist")))
 
-	mux.HandleFunc("/insert", r.handleRedirect)
-	mux.HandleFunc("/replace", r.handleRedirect)
-	mux.HandleFunc("/delete", r.handleRedirect)
-	mux.HandleFunc("/select", r.handleRedirect)
+	mux.HandleFunc("/insert", r.handleWrite)
+	mux.HandleFunc("/replace", r.handleWrite)
+	mux.HandleFunc("/delete", r.handleWrite)
+	mux.HandleFunc("/select", r.handleSelect)
+	mux.HandleFunc("/nearest", r.handleNearest)
+	mux.HandleFunc("/within-distance", r.handleNearest)
+	mux.HandleFunc("/get", r.handleGet)
 	mux.HandleFunc("/checkpoint", r.handleRedirect)
 	mux.HandleFunc("/replication", r.handleRedirect)
+	mux.HandleFunc("/backup", r.handleRedirect)
+	mux.HandleFunc("/restore", r.handleRedirect)
+	mux.HandleFunc("/rebalance", r.handleRebalance)
 
 	return r
 }
@@ -32,6 +98,588 @@ func (r *Router) Stop() {
 	slog.Info("Router is stopping")
 }
 
+// splitSectors splits mapBounds into a grid of geo squares and assigns
+// them to the shards in round-robin order.
+func (r *Router) splitSectors() {
+	n := len(r.shards)
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := int(math.Ceil(float64(n) / float64(cols)))
+
+	width := (mapBounds.Max[0] - mapBounds.Min[0]) / float64(cols)
+	height := (mapBounds.Max[1] - mapBounds.Min[1]) / float64(rows)
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			min := [2]float64{mapBounds.Min[0] + float64(col)*width, mapBounds.Min[1] + float64(row)*height}
+			max := [2]float64{min[0] + width, min[1] + height}
+			r.table.Insert(min, max, r.shards[(row*cols+col)%n])
+		}
+	}
+}
+
+// lookup returns all shards whose sectors intersect the bound. The caller
+// must hold r.mu.
+func (r *Router) lookup(bound orb.Bound) []*Shard {
+	var shards []*Shard
+	seen := make(map[*Shard]bool)
+	r.table.Search(bound.Min, bound.Max, func(min, max [2]float64, shard *Shard) bool {
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+		return true
+	})
+	return shards
+}
+
+// owns reports whether the shard owns a sector which intersects the bound.
+// The caller must hold r.mu.
+func (r *Router) owns(shard *Shard, bound orb.Bound) bool {
+	found := false
+	r.table.Search(bound.Min, bound.Max, func(min, max [2]float64, s *Shard) bool {
+		found = s == shard
+		return !found
+	})
+	return found
+}
+
+// handleWrite sends insert, replace and delete requests to the shards which
+// own the feature's geometry. Writes are proxied rather than redirected, so
+// the Router knows they are applied before a migration is finished.
+func (r *Router) handleWrite(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("node") != "" {
+		r.handleRedirect(w, req)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, util.MaxBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.URL.Path == "/delete" {
+		r.handleDelete(w, req, body)
+		return
+	}
+
+	feature, err := geojson.UnmarshalFeature(body)
+	if err != nil || feature.Geometry == nil {
+		http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+		return
+	}
+
+	// Shards and migrations get the feature in the canonical CRS
+	crs, err := util.RequestCRS(req)
+	if err != nil {
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	feature.Geometry = util.ToCanonical(feature.Geometry, crs)
+	if err := util.ValidateFeature(feature, req.URL.Query().Get("repair") == "true"); err != nil {
+		util.WriteBadRequest(w, err)
+		return
+	}
+
+	// Rebalancing waits for the writes in flight before switching the table
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	bound := feature.Geometry.Bound()
+	shards := r.lookup(bound)
+	if len(shards) == 0 {
+		http.Error(w, "Feature is outside of the map", http.StatusBadRequest)
+		return
+	}
+
+	// A feature written to several shards must have the same ID on each
+	if feature.ID == nil && req.URL.Path == "/insert" {
+		feature.ID = util.NewID()
+	}
+	if body, err = feature.MarshalJSON(); err != nil {
+		http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+		return
+	}
+
+	// The write concern and other parameters are passed on to the shards,
+	// the feature is already reprojected and repaired
+	query := req.URL.Query()
+	query.Del("proj")
+	query.Del("repair")
+	if req.URL.Path == "/replace" {
+		r.handleReplace(w, req, feature, body, shards, query)
+		return
+	}
+	target := req.URL.Path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	// A feature crossing a sector border is written to every owning shard.
+	// If one rejects it, it is deleted again from the shards written before.
+	var versions []string
+	for i, shard := range shards {
+		resp := r.write(shard, req.Method, target, body, r.versionHeader(shard, req.Header))
+		if resp.code >= http.StatusBadRequest {
+			slog.Error("Shard rejected write", "shard", shard.leader(), "code", resp.code)
+			r.undoInsert(shards[:i], feature.ID)
+			w.WriteHeader(resp.code)
+			w.Write(resp.body.Bytes())
+			return
+		}
+		if etag := resp.header.Get("ETag"); etag != "" {
+			versions = append(versions, strings.Trim(etag, `"`))
+		}
+	}
+
+	for _, m := range r.migrations {
+		if m.bound.Intersects(bound) {
+			m.record(req.URL.Path, body)
+		}
+	}
+
+	if len(versions) > 0 {
+		w.Header().Set("ETag", `"`+strings.Join(versions, "+")+`"`)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// undoInsert deletes an inserted feature from the shards. A shard which
+// fails to delete it keeps a copy, which is logged.
+func (r *Router) undoInsert(shards []*Shard, id any) {
+	target := "/delete?" + url.Values{"id": {fmt.Sprint(id)}}.Encode()
+	for _, shard := range shards {
+		resp := r.write(shard, http.MethodPost, target, nil, nil)
+		if resp.code >= http.StatusBadRequest && resp.code != http.StatusNotFound {
+			slog.Error("Shard failed to undo insert", "shard", shard.leader(), "id", id, "code", resp.code)
+		}
+	}
+}
+
+// handleReplace writes a feature to the shards which own its new geometry.
+// The shards holding the old one are found first: they get a replace if they
+// still own the feature and a delete if they do not, new owners get an insert.
+func (r *Router) handleReplace(w http.ResponseWriter, req *http.Request, feature *geojson.Feature, body []byte, owners []*Shard, query url.Values) {
+	if feature.ID == nil || feature.ID == "" {
+		http.Error(w, "Missing feature ID", http.StatusBadRequest)
+		return
+	}
+	id := fmt.Sprint(feature.ID)
+
+	var holders []*Shard
+	current := make(map[*Shard]string)
+	for _, shard := range r.shards {
+		resp := r.write(shard, http.MethodGet, "/get?"+url.Values{"id": {id}}.Encode(), nil, nil)
+		if resp.code == http.StatusNotFound {
+			continue
+		}
+		if resp.code != http.StatusOK {
+			slog.Error("Shard failed to get", "shard", shard.leader(), "code", resp.code)
+			http.Error(w, "Shard "+shard.leader()+" failed to get", http.StatusBadGateway)
+			return
+		}
+		holders = append(holders, shard)
+		current[shard] = strings.Trim(resp.header.Get("ETag"), `"`)
+	}
+	if len(holders) == 0 {
+		http.Error(w, "Feature not found", http.StatusNotFound)
+		return
+	}
+
+	// Check every version before any shard is changed, so a mismatch on the
+	// last shard does not leave the others written
+	for _, shard := range holders {
+		header := r.versionHeader(shard, req.Header)
+		if header == nil || current[shard] == "" {
+			continue
+		}
+		tags := util.ParseETags(header.Get("If-Match"))
+		if !slices.Contains(tags, "*") && !slices.Contains(tags, current[shard]) {
+			http.Error(w, "Feature version does not match", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	suffix := ""
+	if len(query) > 0 {
+		suffix = "?" + query.Encode()
+	}
+	deleteQuery := url.Values{"id": {id}}
+	for key, values := range query {
+		deleteQuery[key] = values
+	}
+	deleteTarget := "/delete?" + deleteQuery.Encode()
+
+	fail := func(shard *Shard, resp *responseBuffer) {
+		slog.Error("Shard rejected write", "shard", shard.leader(), "code", resp.code)
+		w.WriteHeader(resp.code)
+		w.Write(resp.body.Bytes())
+	}
+
+	var versions []string
+	for _, shard := range owners {
+		var resp *responseBuffer
+		if slices.Contains(holders, shard) {
+			resp = r.write(shard, req.Method, "/replace"+suffix, body, r.versionHeader(shard, req.Header))
+		} else {
+			resp = r.write(shard, req.Method, "/insert"+suffix, body, nil)
+		}
+		if resp.code >= http.StatusBadRequest {
+			fail(shard, resp)
+			return
+		}
+		if etag := resp.header.Get("ETag"); etag != "" {
+			versions = append(versions, strings.Trim(etag, `"`))
+		}
+	}
+	// Copies on shards which no longer own the feature are removed
+	for _, shard := range holders {
+		if slices.Contains(owners, shard) {
+			continue
+		}
+		resp := r.write(shard, req.Method, deleteTarget, nil, r.versionHeader(shard, req.Header))
+		if resp.code >= http.StatusBadRequest && resp.code != http.StatusNotFound {
+			fail(shard, resp)
+			return
+		}
+	}
+
+	// A migration target may not have the feature yet, or may have a copy
+	// which moved out of the migrated region
+	bound := feature.Geometry.Bound()
+	for _, m := range r.migrations {
+		if m.bound.Intersects(bound) {
+			m.record("/insert", body)
+		} else {
+			m.record(deleteTarget, nil)
+		}
+	}
+
+	if len(versions) > 0 {
+		w.Header().Set("ETag", `"`+strings.Join(versions, "+")+`"`)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDelete sends a delete to every shard, since only the ID of the
+// feature is known. It is not found if no shard has it.
+func (r *Router) handleDelete(w http.ResponseWriter, req *http.Request, body []byte) {
+	if _, err := util.ParseID(req.URL.Query().Get("id"), body); err != nil {
+		http.Error(w, "Missing feature ID", http.StatusBadRequest)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	target := req.URL.Path
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+
+	found := false
+	for _, shard := range r.shards {
+		resp := r.write(shard, req.Method, target, body, r.versionHeader(shard, req.Header))
+		if resp.code == http.StatusNotFound {
+			continue
+		}
+		if resp.code >= http.StatusBadRequest {
+			slog.Error("Shard rejected write", "shard", shard.leader(), "code", resp.code)
+			w.WriteHeader(resp.code)
+			w.Write(resp.body.Bytes())
+			return
+		}
+		found = true
+	}
+	if !found {
+		http.Error(w, "Feature not found", http.StatusNotFound)
+		return
+	}
+
+	for _, m := range r.migrations {
+		m.record(target, body)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSelect sends the query to every shard whose sector intersects the
+// rect (map) and merges the returned features into one collection (reduce).
+func (r *Router) handleSelect(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("node") != "" {
+		r.handleRedirect(w, req)
+		return
+	}
+
+	query, err := util.ParseQuery(req.URL.Query())
+	if err != nil {
+		util.WriteBadRequest(w, err)
+		return
+	}
+	crs, err := util.ResponseCRS(req)
+	if err != nil {
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	// The routing table must not change between the map and reduce steps
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Disjoint features can be anywhere
+	shards := r.shards
+	if query.Predicate != util.Disjoint {
+		shards = r.lookup(orb.Bound{Min: query.Rect[0], Max: query.Rect[1]})
+	}
+
+	results := make([]*geojson.FeatureCollection, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.query(shard, "/select", req.URL.RawQuery)
+		}()
+	}
+	wg.Wait()
+
+	featureCollection := geojson.NewFeatureCollection()
+	versions := make(map[string]string)
+	seen := make(map[any]bool)
+	for i, result := range results {
+		if errs[i] != nil {
+			slog.Error("Shard failed to select", "shard", shards[i].leader(), "error", errs[i])
+			http.Error(w, "Shard "+shards[i].leader()+" failed to select", http.StatusBadGateway)
+			return
+		}
+
+		for _, feature := range result.Features {
+			// Skip copies left behind on a shard after rebalancing
+			if feature.Geometry != nil && !r.owns(shards[i], feature.Geometry.Bound()) {
+				continue
+			}
+
+			// Features crossing a sector border are stored on several shards
+			if feature.ID != nil {
+				addVersion(versions, fmt.Sprint(feature.ID), result.ExtraMembers)
+				if seen[feature.ID] {
+					continue
+				}
+				seen[feature.ID] = true
+			}
+			featureCollection.Append(util.ReprojectFeature(feature, crs))
+		}
+	}
+	featureCollection.ExtraMembers = geojson.Properties{"versions": versions}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Crs", crs)
+	if err := json.NewEncoder(w).Encode(featureCollection); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// handleNearest runs a nearest or within-distance search on the shards and
+// merges their results by distance. Without a maximum distance the nearest
+// features can be on any shard, so every shard is asked for k features.
+func (r *Router) handleNearest(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("node") != "" {
+		r.handleRedirect(w, req)
+		return
+	}
+
+	nearest, err := util.ParseNearest(req.URL.Query())
+	if err != nil {
+		util.WriteBadRequest(w, err)
+		return
+	}
+	if req.URL.Path == "/within-distance" && nearest.Meters == 0 {
+		v := &util.ValidationError{}
+		v.Add("meters", "is required")
+		util.WriteBadRequest(w, v)
+		return
+	}
+	k := nearest.K
+	if k == 0 && req.URL.Path == "/nearest" {
+		k = util.DefaultNearest
+	}
+	crs, err := util.ResponseCRS(req)
+	if err != nil {
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shards := r.shards
+	if nearest.Meters > 0 {
+		shards = r.lookup(geo.NewBoundAroundPoint(nearest.Point, nearest.Meters))
+	}
+
+	results := make([]*geojson.FeatureCollection, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.query(shard, req.URL.Path, req.URL.RawQuery)
+		}()
+	}
+	wg.Wait()
+
+	type neighbor struct {
+		feature  *geojson.Feature
+		distance float64
+	}
+	var neighbors []neighbor
+	versions := make(map[string]string)
+	seen := make(map[string]bool)
+	for i, result := range results {
+		if errs[i] != nil {
+			slog.Error("Shard failed to search", "shard", shards[i].leader(), "error", errs[i])
+			http.Error(w, "Shard "+shards[i].leader()+" failed to search", http.StatusBadGateway)
+			return
+		}
+
+		shardDistances, _ := result.ExtraMembers["distances"].(map[string]any)
+		for _, feature := range result.Features {
+			if feature.Geometry != nil && !r.owns(shards[i], feature.Geometry.Bound()) {
+				continue
+			}
+
+			id := fmt.Sprint(feature.ID)
+			addVersion(versions, id, result.ExtraMembers)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			distance, _ := shardDistances[id].(float64)
+			neighbors = append(neighbors, neighbor{feature: feature, distance: distance})
+		}
+	}
+
+	sort.SliceStable(neighbors, func(i, j int) bool {
+		return neighbors[i].distance < neighbors[j].distance
+	})
+	if k > 0 && len(neighbors) > k {
+		neighbors = neighbors[:k]
+	}
+
+	featureCollection := geojson.NewFeatureCollection()
+	keptVersions := make(map[string]string)
+	distances := make(map[string]float64)
+	for _, n := range neighbors {
+		id := fmt.Sprint(n.feature.ID)
+		featureCollection.Append(util.ReprojectFeature(n.feature, crs))
+		if v, ok := versions[id]; ok {
+			keptVersions[id] = v
+		}
+		distances[id] = n.distance
+	}
+	featureCollection.ExtraMembers = geojson.Properties{"versions": keptVersions, "distances": distances}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Crs", crs)
+	if err := json.NewEncoder(w).Encode(featureCollection); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// handleGet asks every shard for the feature, since only its ID is known.
+// The ETag joins the versions of the feature on every shard with "+".
+func (r *Router) handleGet(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("node") != "" {
+		r.handleRedirect(w, req)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var body []byte
+	var contentCrs string
+	var versions []string
+	header := http.Header{"Accept-Crs": req.Header.Values("Accept-Crs")}
+	for _, shard := range r.shards {
+		resp := r.forward(http.MethodGet, "/"+shard.leader()+"/get?"+req.URL.RawQuery, nil, header)
+		if resp.code == http.StatusNotFound {
+			continue
+		}
+		if resp.code != http.StatusOK {
+			slog.Error("Shard failed to get", "shard", shard.leader(), "code", resp.code)
+			http.Error(w, "Shard "+shard.leader()+" failed to get", http.StatusBadGateway)
+			return
+		}
+		if body == nil {
+			body = resp.body.Bytes()
+			contentCrs = resp.header.Get("Content-Crs")
+		}
+		if etag := resp.header.Get("ETag"); etag != "" {
+			versions = append(versions, strings.Trim(etag, `"`))
+		}
+	}
+	if body == nil {
+		http.Error(w, "Feature not found", http.StatusNotFound)
+		return
+	}
+
+	if len(versions) > 0 {
+		w.Header().Set("ETag", `"`+strings.Join(versions, "+")+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Crs", contentCrs)
+	w.Write(body)
+}
+
+// versionHeader passes the If-Match header of a write on to a shard. An
+// ETag of the Router joins the versions of every shard, the shard gets the
+// versions written by its own nodes.
+func (r *Router) versionHeader(shard *Shard, header http.Header) http.Header {
+	ifMatch := header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range util.ParseETags(ifMatch) {
+		for _, v := range strings.Split(tag, "+") {
+			name, _, _ := strings.Cut(v, ":")
+			if v == "*" || slices.Contains(shard.replicaset, name) {
+				tags = append(tags, `"`+v+`"`)
+			}
+		}
+	}
+	// Versions of other shards only never match, so the write fails
+	if len(tags) == 0 {
+		return http.Header{"If-Match": {ifMatch}}
+	}
+	return http.Header{"If-Match": {strings.Join(tags, ", ")}}
+}
+
+// addVersion adds the version of a feature on one shard, taken from the
+// versions member of its select result.
+func addVersion(versions map[string]string, id string, members geojson.Properties) {
+	shardVersions, _ := members["versions"].(map[string]any)
+	v, ok := shardVersions[id].(string)
+	if !ok {
+		return
+	}
+	if versions[id] != "" {
+		v = versions[id] + "+" + v
+	}
+	versions[id] = v
+}
+
 func (r *Router) handleRedirect(w http.ResponseWriter, req *http.Request) {
 	node := req.URL.Query().Get("node")
 	if node == "" {
@@ -59,5 +707,77 @@ func (r *Router) handleRedirect(w http.ResponseWriter, req *http.Request) {
 	}
 
 	target := "/" + node + req.URL.Path
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
 	http.Redirect(w, req, target, http.StatusTemporaryRedirect)
 }
+
+// query reads features from the shard's leader by a select or nearest
+// search path. The features come in the canonical CRS.
+func (r *Router) query(shard *Shard, path string, rawQuery string) (*geojson.FeatureCollection, error) {
+	header := http.Header{"Accept-Crs": {util.CanonicalCRS}}
+	resp := r.forward(http.MethodGet, "/"+shard.leader()+path+"?"+rawQuery, nil, header)
+	if resp.code == http.StatusTemporaryRedirect {
+		// The leader is busy and sent us to one of its replicas
+		resp = r.forward(http.MethodGet, resp.header.Get("Location"), nil, header)
+	}
+	if resp.code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.code, resp.body.String())
+	}
+	return geojson.UnmarshalFeatureCollection(resp.body.Bytes())
+}
+
+// write sends a write request to the shard's leader. A follower redirects it
+// to the current leader, which is remembered for the next writes.
+func (r *Router) write(shard *Shard, method string, path string, body []byte, header http.Header) *responseBuffer {
+	resp := r.forward(method, "/"+shard.leader()+path, body, header)
+	if resp.code == http.StatusTemporaryRedirect && resp.header.Get("X-Leader") != "" {
+		shard.setLeader(resp.header.Get("X-Leader"))
+		resp = r.forward(method, resp.header.Get("Location"), body, header)
+	}
+	return resp
+}
+
+// forward serves the request on a Storage handler and returns its response.
+func (r *Router) forward(method string, target string, body []byte, header http.Header) *responseBuffer {
+	resp := &responseBuffer{header: make(http.Header), code: http.StatusOK}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		resp.code = http.StatusInternalServerError
+		return resp
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	r.mux.ServeHTTP(resp, req)
+	return resp
+}
+
+// responseBuffer is an http.ResponseWriter which keeps the response in memory.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(data)
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	// Like net/http, only the first status code counts
+	if b.wrote {
+		return
+	}
+	b.code = code
+	b.wrote = true
+}
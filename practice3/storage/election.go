@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"practice3/util"
+	"time"
+)
+
+const (
+	heartbeatInterval  = 200 * time.Millisecond
+	minElectionTimeout = 1 * time.Second
+	maxElectionTimeout = 2 * time.Second
+)
+
+// runElection sends heartbeats while the Storage is the leader and starts an
+// election when a follower has not heard from the leader for too long.
+func (s *Storage) runElection() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.electionMu.Lock()
+			if s.leader {
+				s.Engine.Broadcast(util.Transaction{Action: "heartbeat", Name: s.name, Term: s.term})
+			} else if time.Now().After(s.electionDeadline) {
+				s.startElection()
+			}
+			s.electionMu.Unlock()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// startElection makes the Storage a candidate for the next term and asks the
+// Replicas for votes. The caller must hold s.electionMu.
+func (s *Storage) startElection() {
+	s.term++
+	s.candidate = true
+	s.votedFor = s.name
+	s.votes = map[string]bool{s.name: true}
+	s.leaderName = ""
+	s.resetElectionDeadline()
+
+	slog.Info("Starting election", "name", s.name, "term", s.term)
+
+	if s.hasMajority() {
+		s.becomeLeader()
+		return
+	}
+
+	s.Engine.Broadcast(util.Transaction{
+		Action: "request_vote",
+		Name:   s.name,
+		Term:   s.term,
+		VClock: s.Engine.VClock(),
+	})
+}
+
+// handleElectionMessage processes heartbeats and votes received from a
+// replica connection.
+func (s *Storage) handleElectionMessage(conn *websocket.Conn, tx util.Transaction) {
+	s.electionMu.Lock()
+	defer s.electionMu.Unlock()
+
+	// Anyone with a newer term knows better, so step down
+	if tx.Term > s.term {
+		s.term = tx.Term
+		s.votedFor = ""
+		s.stepDown()
+	}
+
+	switch tx.Action {
+	case "heartbeat":
+		if tx.Term < s.term {
+			return
+		}
+		if s.leader && tx.Name != s.name {
+			s.stepDown()
+		}
+		s.candidate = false
+		if s.leaderName != tx.Name {
+			slog.Info("New leader", "name", s.name, "leader", tx.Name, "term", tx.Term)
+		}
+		s.leaderName = tx.Name
+		s.resetElectionDeadline()
+	case "request_vote":
+		granted := tx.Term == s.term &&
+			(s.votedFor == "" || s.votedFor == tx.Name) &&
+			upToDate(tx.VClock, s.Engine.VClock())
+		if granted {
+			s.votedFor = tx.Name
+			s.resetElectionDeadline()
+		}
+		s.send(conn, util.Transaction{Action: "vote", Name: s.name, Term: s.term, Granted: granted})
+	case "vote":
+		if !s.candidate || tx.Term != s.term || !tx.Granted {
+			return
+		}
+		s.votes[tx.Name] = true
+		if s.hasMajority() {
+			s.becomeLeader()
+		}
+	}
+}
+
+// becomeLeader is called when the candidate got a majority of votes. The
+// caller must hold s.electionMu.
+func (s *Storage) becomeLeader() {
+	slog.Info("Became leader", "name", s.name, "term", s.term)
+	s.leader = true
+	s.candidate = false
+	s.leaderName = s.name
+	s.Engine.Broadcast(util.Transaction{Action: "heartbeat", Name: s.name, Term: s.term})
+}
+
+// stepDown turns the Storage into a follower. The caller must hold
+// s.electionMu.
+func (s *Storage) stepDown() {
+	if s.leader {
+		slog.Info("Stepping down", "name", s.name, "term", s.term)
+	}
+	s.leader = false
+	s.candidate = false
+	s.leaderName = ""
+	s.resetElectionDeadline()
+}
+
+func (s *Storage) hasMajority() bool {
+	return len(s.votes) > (len(s.Replicas)+1)/2
+}
+
+func (s *Storage) resetElectionDeadline() {
+	timeout := minElectionTimeout + rand.N(maxElectionTimeout-minElectionTimeout)
+	s.electionDeadline = time.Now().Add(timeout)
+}
+
+// send writes a message to a single replica connection.
+func (s *Storage) send(conn *websocket.Conn, tx util.Transaction) {
+	s.Engine.Mu.Lock()
+	defer s.Engine.Mu.Unlock()
+	if err := conn.WriteJSON(tx); err != nil {
+		slog.Error("Failed to send message", "action", tx.Action, "error", err)
+	}
+}
+
+// Leader returns the name of the current leader and the term. The name is
+// empty while there is no known leader.
+func (s *Storage) Leader() (string, uint64) {
+	s.electionMu.Lock()
+	defer s.electionMu.Unlock()
+	return s.leaderName, s.term
+}
+
+// IsLeader reports whether the Storage is the leader of its replicaset.
+func (s *Storage) IsLeader() bool {
+	s.electionMu.Lock()
+	defer s.electionMu.Unlock()
+	return s.leader
+}
+
+func (s *Storage) handleLeader(w http.ResponseWriter, r *http.Request) {
+	leader, term := s.Leader()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"leader": leader, "term": term})
+}
+
+// handleStepDown makes the leader a follower. It waits longer than the other
+// replicas before starting an election, so one of them takes over.
+func (s *Storage) handleStepDown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.electionMu.Lock()
+	defer s.electionMu.Unlock()
+
+	if !s.leader {
+		http.Error(w, "Not a leader", http.StatusConflict)
+		return
+	}
+
+	s.stepDown()
+	s.electionDeadline = time.Now().Add(2 * maxElectionTimeout)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// upToDate reports whether the candidate has applied every transaction the
+// voter has. Being ahead on one origin does not make up for being behind on
+// another.
+func upToDate(candidate, voter map[string]uint64) bool {
+	for name, lsn := range voter {
+		if candidate[name] < lsn {
+			return false
+		}
+	}
+	return true
+}
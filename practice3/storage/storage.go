@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log/slog"
 	"net/http"
@@ -11,38 +14,80 @@ import (
 	"time"
 )
 
+const backupContentType = "application/x-tar"
+
+// A refused snapshot is asked for again after snapshotRetry, doubled on
+// every refusal up to maxSnapshotRetry.
+const (
+	snapshotRetry    = 5 * time.Second
+	maxSnapshotRetry = 5 * time.Minute
+)
+
 type Storage struct {
 	mux          *http.ServeMux
 	name         string
-	DataFile     string
 	Engine       *engine.Engine
 	mu           sync.Mutex
 	Replicas     []string
-	leader       bool
 	requestCount int
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	// Leader election state
+	electionMu       sync.Mutex
+	leader           bool
+	candidate        bool
+	term             uint64
+	votedFor         string
+	votes            map[string]bool
+	leaderName       string
+	electionDeadline time.Time
 }
 
-func NewStorage(mux *http.ServeMux, name string, replicas []string, leader bool) *Storage {
+// NewStorage creates a Storage. The leader flag only picks the initial
+// leader, later the replicaset elects a new one when the leader is gone. The
+// options are passed to the Engine. It returns nil if the Engine cannot load
+// its checkpoint or transaction log.
+func NewStorage(mux *http.ServeMux, name string, replicas []string, leader bool, opts ...engine.Option) *Storage {
 	ctx := context.Background()
-	eng := engine.NewEngine(ctx, "transaction_"+name+".log", name, leader)
+	eng := engine.NewEngine(ctx, "transaction_"+name+".log", name, leader, opts...)
+	if eng == nil {
+		slog.Error("Failed to start engine", "name", name)
+		return nil
+	}
 	s := &Storage{
-		mux:  mux,
-		name: name,
-		//dataFile:  "geo.db.json",
-		DataFile: "test.geo.data.json",
+		mux:      mux,
+		name:     name,
 		Engine:   eng,
 		Replicas: replicas,
 		leader:   leader,
 	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	s.resetElectionDeadline()
+	if leader {
+		s.term = 1
+		s.leaderName = name
+	}
 
 	mux.HandleFunc("/"+name+"/replication", s.handleReplication)
 	mux.HandleFunc("/"+name+"/checkpoint", s.handleCheckpoint)
+	mux.HandleFunc("/"+name+"/checkpoint/status", s.handleCheckpointStatus)
+	mux.HandleFunc("/"+name+"/backup", s.handleBackup)
+	mux.HandleFunc("/"+name+"/restore", s.handleRestore)
 	mux.HandleFunc("/"+name+"/select", s.handleSelect)
+	mux.HandleFunc("/"+name+"/nearest", s.handleNearest)
+	mux.HandleFunc("/"+name+"/within-distance", s.handleWithinDistance)
+	mux.HandleFunc("/"+name+"/get", s.handleGet)
 	mux.HandleFunc("/"+name+"/insert", s.handleInsert)
 	mux.HandleFunc("/"+name+"/replace", s.handleReplace)
 	mux.HandleFunc("/"+name+"/delete", s.handleDelete)
+	mux.HandleFunc("/"+name+"/drop", s.handleDrop)
+	mux.HandleFunc("/"+name+"/leader", s.handleLeader)
+	mux.HandleFunc("/"+name+"/stepdown", s.handleStepDown)
 
 	go s.ConnectToReplicas()
+	go s.runElection()
 
 	return s
 }
@@ -52,6 +97,7 @@ func (s *Storage) Run() {
 }
 
 func (s *Storage) Stop() {
+	s.cancel()
 	s.Engine.Stop()
 	slog.Info("Storage is stopping", "name", s.name)
 }
@@ -66,11 +112,8 @@ func (s *Storage) handleReplication(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("WebSocket connection established", "remote", r.RemoteAddr)
 
-	s.Engine.Mu.Lock()
-	s.Engine.Replicas[r.RemoteAddr] = conn
-	s.Engine.Mu.Unlock()
-
-	// Handle incoming messages
+	// The replica is registered by the engine once it asks for the
+	// transactions it missed
 	for {
 		var tx util.Transaction
 		if err := conn.ReadJSON(&tx); err != nil {
@@ -82,9 +125,12 @@ func (s *Storage) handleReplication(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		slog.Info("Received transaction", "action", tx.Action, "name", tx.Name, "lsn", tx.LSN)
+		if tx.Action == "sync" {
+			s.Engine.CommandCh <- util.Command{Action: "sync", Transaction: tx, Addr: r.RemoteAddr, Conn: conn}
+			continue
+		}
 
-		s.Engine.CommandCh <- util.Command{Action: "replicate", Transaction: tx}
+		s.handleMessage(conn, tx)
 	}
 
 	s.Engine.Mu.Lock()
@@ -92,18 +138,131 @@ func (s *Storage) handleReplication(w http.ResponseWriter, r *http.Request) {
 	s.Engine.Mu.Unlock()
 }
 
+// handleMessage dispatches a message received from a replica connection.
+func (s *Storage) handleMessage(conn *websocket.Conn, tx util.Transaction) {
+	switch tx.Action {
+	case "heartbeat", "request_vote", "vote":
+		s.handleElectionMessage(conn, tx)
+	case "ack":
+		s.Engine.CommandCh <- util.Command{Action: "ack", Transaction: tx}
+	default:
+		slog.Info("Received transaction", "action", tx.Action, "name", tx.Name, "lsn", tx.LSN)
+		s.Engine.CommandCh <- util.Command{Action: "replicate", Transaction: tx, Conn: conn}
+	}
+}
+
+// handleCheckpoint writes a checkpoint, or compacts the delta checkpoints
+// into a new base if the compact parameter is set.
 func (s *Storage) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	action := "checkpoint"
+	if r.URL.Query().Get("compact") == "true" {
+		action = "compact"
+	}
+
 	responseChan := make(chan any)
-	s.Engine.CommandCh <- util.Command{Action: "checkpoint", Response: responseChan}
+	s.Engine.CommandCh <- util.Command{Action: action, Response: responseChan}
 	<-responseChan
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// ConnectToReplicas connects to all Replicas in the Replicas list.
+// handleCheckpointStatus reports the progress of the running checkpoint or
+// the result of the last one.
+func (s *Storage) handleCheckpointStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Engine.CheckpointStatus()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// handleBackup streams a backup archive of the node. Writes go on while it
+// is read.
+func (s *Storage) handleBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", backupContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.name+"-"+time.Now().Format("20060102T150405")+".tar"))
+	if err := s.Engine.Backup(w); err != nil {
+		// The archive misses its manifest, so it fails verification
+		slog.Error("Backup failed", "name", s.name, "error", err)
+	}
+}
+
+// handleRestore brings the node back to the state as of a vclock, given as
+// vclock=name:lsn,..., or a time in RFC 3339. With a backup archive as the
+// body, the archive is loaded into the empty node first and restored to the
+// vclock or time if one is given. It replies with the restored vclock.
+func (s *Storage) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	archive := r.Header.Get("Content-Type") == backupContentType
+	if !archive && !query.Has("vclock") && !query.Has("time") {
+		http.Error(w, "Missing vclock or time", http.StatusBadRequest)
+		return
+	}
+
+	var tx util.Transaction
+	if query.Has("vclock") {
+		vclock, err := util.ParseVClock(query.Get("vclock"))
+		if err != nil {
+			http.Error(w, "Invalid vclock", http.StatusBadRequest)
+			return
+		}
+		tx.VClock = vclock
+	}
+	if query.Has("time") {
+		t, err := time.Parse(time.RFC3339Nano, query.Get("time"))
+		if err != nil {
+			http.Error(w, "Invalid time", http.StatusBadRequest)
+			return
+		}
+		tx.Time = t.UnixNano()
+	}
+
+	var err error
+	if archive {
+		var target *engine.RecoveryTarget
+		if query.Has("vclock") || query.Has("time") {
+			target = &engine.RecoveryTarget{VClock: tx.VClock}
+			if tx.Time != 0 {
+				target.Time = time.Unix(0, tx.Time)
+			}
+		}
+		err = s.Engine.RestoreBackup(r.Body, target)
+	} else {
+		responseChan := make(chan any, 1)
+		s.Engine.CommandCh <- util.Command{Action: "restore", Transaction: tx, Response: responseChan}
+		err, _ = (<-responseChan).(error)
+	}
+
+	switch {
+	case errors.Is(err, engine.ErrInvalidBackup):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, engine.ErrNotEmpty):
+		http.Error(w, "Node is not empty", http.StatusConflict)
+		return
+	case err != nil:
+		slog.Error("Restore failed", "name", s.name, "error", err)
+		http.Error(w, "Failed to restore: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Engine.VClock()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// ConnectToReplicas connects to all Replicas in the Replicas list. After
+// connecting it sends its vclock, and the replica replies with the
+// transactions missed while the link was down followed by the new ones.
 func (s *Storage) ConnectToReplicas() {
 	for _, replica := range s.Replicas {
 		go func(addr string) {
+			backoff := snapshotRetry
 			for {
 				wsURL := "ws://" + addr + "/replication"
 				slog.Info("Connecting to replica", "url", wsURL)
@@ -114,15 +273,12 @@ func (s *Storage) ConnectToReplicas() {
 					time.Sleep(5 * time.Second) // Retry after 5 seconds
 					continue
 				}
-				defer conn.Close()
-
 				slog.Info("WebSocket connection established", "replica", addr)
 
-				s.Engine.Mu.Lock()
-				s.Engine.Replicas[addr] = conn
-				s.Engine.Mu.Unlock()
+				s.send(conn, util.Transaction{Action: "sync", Name: s.name, VClock: s.Engine.VClock()})
 
 				// Handle incoming messages
+				refused := false
 				for {
 					var tx util.Transaction
 					if err := conn.ReadJSON(&tx); err != nil {
@@ -133,15 +289,64 @@ func (s *Storage) ConnectToReplicas() {
 						}
 						break
 					}
-					slog.Info("Received transaction", "replica", addr, "action", tx.Action, "name", tx.Name, "lsn", tx.LSN)
+					if tx.Action == "snapshot_begin" {
+						err := s.receiveSnapshot(conn, tx)
+						if errors.Is(err, engine.ErrSnapshotBehind) {
+							// The replica sends the same snapshot until it
+							// catches up, so it is asked again less often
+							slog.Warn("Refused snapshot of a replica behind this node", "replica", addr, "retry", backoff, "error", err)
+							refused = true
+							break
+						}
+						if err != nil {
+							slog.Error("Failed to receive snapshot", "replica", addr, "error", err)
+							break
+						}
+						backoff = snapshotRetry
+						continue
+					}
 
-					s.Engine.CommandCh <- util.Command{Action: "replicate", Transaction: tx}
+					s.handleMessage(conn, tx)
 				}
 
-				s.Engine.Mu.Lock()
-				delete(s.Engine.Replicas, addr)
-				s.Engine.Mu.Unlock()
+				conn.Close()
+				if refused {
+					select {
+					case <-s.ctx.Done():
+						return
+					case <-time.After(backoff):
+					}
+					backoff = min(2*backoff, maxSnapshotRetry)
+				}
 			}
 		}(replica)
 	}
 }
+
+// receiveSnapshot reads the features of a snapshot until its end and hands
+// them to the engine, which replaces its data at once. A snapshot behind the
+// engine is refused.
+func (s *Storage) receiveSnapshot(conn *websocket.Conn, begin util.Transaction) error {
+	slog.Info("Receiving snapshot", "name", s.name, "replica", begin.Name)
+
+	var snapshot []util.Transaction
+	for {
+		var tx util.Transaction
+		if err := conn.ReadJSON(&tx); err != nil {
+			return err
+		}
+
+		switch tx.Action {
+		case "snapshot":
+			snapshot = append(snapshot, tx)
+		case "snapshot_end":
+			responseChan := make(chan any)
+			s.Engine.CommandCh <- util.Command{Action: "snapshot", Snapshot: snapshot, Transaction: tx, Conn: conn, Response: responseChan}
+			err, _ := (<-responseChan).(error)
+			return err
+		default:
+			// Heartbeats may come in between
+			s.handleMessage(conn, tx)
+		}
+	}
+}
@@ -2,184 +2,354 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/paulmach/orb/geojson"
 	"io"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
-	"os"
+	"path"
+	"practice3/engine"
 	"practice3/util"
-	"strconv"
 	"strings"
 	"time"
 )
 
+// writeTimeout is how long a write waits for the Replicas to acknowledge it.
+const writeTimeout = 2 * time.Second
+
 func (s *Storage) handleSelect(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
 	s.mu.Lock()
-	s.requestCount++
-	if s.requestCount > 3 {
+	// Too many requests in flight, so let a replica serve this one. A request
+	// which was already redirected is served here to avoid redirect loops.
+	if s.requestCount >= 3 && len(s.Replicas) > 0 && query.Get("redirected") == "" {
 		s.mu.Unlock()
-		http.Redirect(w, r, "http://replica/select", http.StatusTemporaryRedirect)
+		query.Set("redirected", "true")
+		// Replicas are host/name addresses, the redirect stays on this server
+		replica := path.Base(s.Replicas[rand.IntN(len(s.Replicas))])
+		http.Redirect(w, r, "/"+replica+"/select?"+query.Encode(), http.StatusTemporaryRedirect)
 		return
 	}
-	defer s.mu.Unlock()
+	s.requestCount++
+	s.mu.Unlock()
 
-	rect := parseRect(r.URL.Query().Get("rect"))
-	if rect == nil {
-		http.Error(w, "Invalid rect parameter", http.StatusBadRequest)
+	defer func() {
+		s.mu.Lock()
+		s.requestCount--
+		s.mu.Unlock()
+	}()
+
+	spatial, err := util.ParseQuery(query)
+	if err != nil {
+		util.WriteBadRequest(w, err)
+		return
+	}
+	crs, err := util.ResponseCRS(r)
+	if err != nil {
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusNotAcceptable)
 		return
 	}
 
 	responseChan := make(chan any)
-	s.Engine.CommandCh <- util.Command{Action: "select", Rect: *rect, Response: responseChan}
-	features := <-responseChan
-
-	featureCollection := geojson.NewFeatureCollection()
-	for _, feature := range features.([]*geojson.Feature) {
-		featureCollection.Append(feature)
+	s.Engine.CommandCh <- util.Command{
+		Action:    "select",
+		Rect:      spatial.Rect,
+		Predicate: spatial.Predicate,
+		Geometry:  spatial.Geometry,
+		Filter:    spatial.Filter,
+		Response:  responseChan,
 	}
+	selection := (<-responseChan).(engine.Selection)
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(featureCollection); err != nil {
+	w.Header().Set("Content-Crs", crs)
+	if err := json.NewEncoder(w).Encode(collection(selection.Features, selection.Versions, crs)); err != nil {
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
-func (s *Storage) handleInsert(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// collection puts the features into a collection with their versions. The
+// versions are a foreign member, so the features stay as stored.
+func collection(features []*geojson.Feature, versions map[string]string, crs string) *geojson.FeatureCollection {
+	featureCollection := geojson.NewFeatureCollection()
+	for _, feature := range features {
+		featureCollection.Append(util.ReprojectFeature(feature, crs))
+	}
+	featureCollection.ExtraMembers = geojson.Properties{"versions": versions}
+	return featureCollection
+}
+
+// handleNearest returns the k features nearest to the point, 10 if k is not
+// given.
+func (s *Storage) handleNearest(w http.ResponseWriter, r *http.Request) {
+	s.nearest(w, r, false)
+}
 
-	body, err := io.ReadAll(r.Body)
+// handleWithinDistance returns the features within meters of the point.
+func (s *Storage) handleWithinDistance(w http.ResponseWriter, r *http.Request) {
+	s.nearest(w, r, true)
+}
+
+// nearest runs a nearest search and returns the features ordered by
+// distance. The distances in meters are a foreign member like the versions.
+func (s *Storage) nearest(w http.ResponseWriter, r *http.Request, withinDistance bool) {
+	nearest, err := util.ParseNearest(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		util.WriteBadRequest(w, err)
 		return
 	}
-
-	feature, err := geojson.UnmarshalFeature(body)
+	if withinDistance && nearest.Meters == 0 {
+		v := &util.ValidationError{}
+		v.Add("meters", "is required")
+		util.WriteBadRequest(w, v)
+		return
+	}
+	if !withinDistance && nearest.K == 0 {
+		nearest.K = util.DefaultNearest
+	}
+	crs, err := util.ResponseCRS(r)
 	if err != nil {
-		http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusNotAcceptable)
 		return
 	}
 
-	//slog.Info("Sending insert transaction", "id", feature.ID)
 	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "nearest", Nearest: *nearest, Response: responseChan}
+	neighbors := (<-responseChan).([]engine.Neighbor)
 
-	select {
-	case s.Engine.CommandCh <- util.Command{Action: "insert", Feature: feature, Response: responseChan}:
-		select {
-		case <-responseChan:
-			w.WriteHeader(http.StatusOK)
-		case <-time.After(2 * time.Second):
-			//http.Error(w, "Request timed out", http.StatusRequestTimeout)
-			// Very bad fix
-			w.WriteHeader(http.StatusOK)
-		}
-	default:
-		http.Error(w, "Engine is busy", http.StatusServiceUnavailable)
+	features := make([]*geojson.Feature, len(neighbors))
+	versions := make(map[string]string)
+	distances := make(map[string]float64)
+	for i, neighbor := range neighbors {
+		features[i] = neighbor.Feature
+		versions[fmt.Sprint(neighbor.Feature.ID)] = neighbor.Version
+		distances[fmt.Sprint(neighbor.Feature.ID)] = neighbor.Distance
 	}
+	featureCollection := collection(features, versions, crs)
+	featureCollection.ExtraMembers["distances"] = distances
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Crs", crs)
+	if err := json.NewEncoder(w).Encode(featureCollection); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
 }
 
-func (s *Storage) handleReplace(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+// handleGet returns the feature with the id parameter and its version as the
+// ETag.
+func (s *Storage) handleGet(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing feature ID", http.StatusBadRequest)
 		return
 	}
-
-	feature, err := geojson.UnmarshalFeature(body)
+	crs, err := util.ResponseCRS(r)
 	if err != nil {
-		http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+		http.Error(w, "Invalid CRS: "+err.Error(), http.StatusNotAcceptable)
 		return
 	}
+	query := geojson.NewFeature(nil)
+	query.ID = id
 
 	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "get", Feature: query, Response: responseChan}
+	feature := (<-responseChan).(*geojson.Feature)
+	if feature == nil {
+		http.Error(w, "Feature not found", http.StatusNotFound)
+		return
+	}
 
-	select {
-	case s.Engine.CommandCh <- util.Command{Action: "insert", Feature: feature, Response: responseChan}:
-		select {
-		case <-responseChan:
-			w.WriteHeader(http.StatusOK)
-		case <-time.After(2 * time.Second):
-			//http.Error(w, "Request timed out", http.StatusRequestTimeout)
-			// Very bad fix
-			w.WriteHeader(http.StatusOK)
-		}
-	default:
-		http.Error(w, "Engine is busy", http.StatusServiceUnavailable)
+	if v, ok := s.Engine.Version(feature); ok {
+		w.Header().Set("ETag", `"`+v+`"`)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Crs", crs)
+	if err := json.NewEncoder(w).Encode(util.ReprojectFeature(feature, crs)); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
+func (s *Storage) handleInsert(w http.ResponseWriter, r *http.Request) {
+	s.write(w, r, "insert")
 }
 
-func (s *Storage) handleDelete(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Storage) handleReplace(w http.ResponseWriter, r *http.Request) {
+	s.write(w, r, "replace")
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+// write applies a write on the leader and waits until as many Replicas as
+// the write_concern parameter asks for acknowledged it. The write is reported
+// as failed if they do not answer in time. The Engine itself is always waited
+// for, since a queued command is applied anyway and a client retrying after
+// a timeout would see its own write as a conflict. A replace or delete with
+// If-Match fails unless the stored version is one of the given ones. The
+// version of a written feature is returned as the ETag.
+func (s *Storage) write(w http.ResponseWriter, r *http.Request, action string) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
 		return
 	}
 
-	feature, err := geojson.UnmarshalFeature(body)
+	acks, err := s.writeConcern(r.URL.Query().Get("write_concern"))
 	if err != nil {
-		http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+		http.Error(w, "Invalid write_concern parameter", http.StatusBadRequest)
 		return
 	}
 
-	data, err := os.ReadFile(s.DataFile)
-	if err != nil && !os.IsNotExist(err) {
-		http.Error(w, "Error reading data file", http.StatusInternalServerError)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, util.MaxBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	var featureCollection *geojson.FeatureCollection
-	if len(data) > 0 {
-		featureCollection, err = geojson.UnmarshalFeatureCollection(data)
+	var feature *geojson.Feature
+	if action == "delete" {
+		id, err := util.ParseID(r.URL.Query().Get("id"), body)
 		if err != nil {
-			http.Error(w, "Error parsing data file", http.StatusInternalServerError)
+			http.Error(w, "Missing feature ID", http.StatusBadRequest)
 			return
 		}
+		feature = geojson.NewFeature(nil)
+		feature.ID = id
 	} else {
-		featureCollection = geojson.NewFeatureCollection()
+		feature, err = geojson.UnmarshalFeature(body)
+		if err != nil || feature.Geometry == nil {
+			http.Error(w, "Invalid GeoJSON object", http.StatusBadRequest)
+			return
+		}
+		crs, err := util.RequestCRS(r)
+		if err != nil {
+			http.Error(w, "Invalid CRS: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		feature.Geometry = util.ToCanonical(feature.Geometry, crs)
+		if err := util.ValidateFeature(feature, r.URL.Query().Get("repair") == "true"); err != nil {
+			util.WriteBadRequest(w, err)
+			return
+		}
+	}
+
+	responseChan := make(chan any, 1)
+
+	s.mu.Lock()
+	select {
+	case s.Engine.CommandCh <- util.Command{Action: action, Feature: feature, IfMatch: util.ParseETags(r.Header.Get("If-Match")), Response: responseChan}:
+	default:
+		s.mu.Unlock()
+		http.Error(w, "Engine is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	var resp any
+	select {
+	case resp = <-responseChan:
+	case <-s.Engine.Done():
+		// The Engine may have answered just before it stopped
+		select {
+		case resp = <-responseChan:
+		default:
+			s.mu.Unlock()
+			http.Error(w, "Engine stopped before the write was applied", http.StatusServiceUnavailable)
+			return
+		}
 	}
+	s.mu.Unlock()
 
-	newFeatures := make([]*geojson.Feature, 0)
-	for _, f := range featureCollection.Features {
-		if f.ID != feature.ID {
-			newFeatures = append(newFeatures, f)
+	var lsn uint64
+	switch resp := resp.(type) {
+	case error:
+		switch {
+		case errors.Is(resp, engine.ErrDuplicateID):
+			http.Error(w, "Feature ID already exists", http.StatusConflict)
+		case errors.Is(resp, engine.ErrNotFound):
+			http.Error(w, "Feature not found", http.StatusNotFound)
+		case errors.Is(resp, engine.ErrVersionMismatch):
+			http.Error(w, "Feature version does not match", http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Failed to write transaction log: "+resp.Error(), http.StatusInternalServerError)
 		}
+		return
+	case uint64:
+		lsn = resp
+	}
+
+	if !s.Engine.WaitForAcks(lsn, acks, writeTimeout) {
+		slog.Error("Write is not acknowledged", "name", s.name, "lsn", lsn, "acks", acks)
+		http.Error(w, "Write is not acknowledged by enough replicas", http.StatusGatewayTimeout)
+		return
 	}
 
-	featureCollection.Features = newFeatures
+	if action != "delete" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s:%d"`, s.name, lsn))
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	write, err := featureCollection.MarshalJSON()
-	if err != nil {
-		http.Error(w, "Error parsing json file", http.StatusInternalServerError)
+// writeConcern returns how many Replicas must acknowledge a write: none for
+// "local", all of them for "all" and a majority of the replicaset otherwise.
+func (s *Storage) writeConcern(concern string) (int, error) {
+	switch concern {
+	case "local":
+		return 0, nil
+	case "", "majority":
+		return (len(s.Replicas) + 1) / 2, nil
+	case "all":
+		return len(s.Replicas), nil
+	default:
+		return 0, fmt.Errorf("unknown write concern %q", concern)
+	}
+}
+
+// handleDelete deletes a feature by its ID, given as the id parameter or in
+// the body.
+func (s *Storage) handleDelete(w http.ResponseWriter, r *http.Request) {
+	s.write(w, r, "delete")
+}
+
+// handleDrop deletes the features inside the rect after the Router moved
+// them to another shard.
+func (s *Storage) handleDrop(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
 		return
 	}
-	err = os.WriteFile(s.DataFile, write, 0644)
-	if err != nil {
-		http.Error(w, "Error writing data file", http.StatusInternalServerError)
+
+	rect := util.ParseRect(r.URL.Query().Get("rect"))
+	if rect == nil {
+		http.Error(w, "Invalid rect parameter", http.StatusBadRequest)
 		return
 	}
 
+	responseChan := make(chan any)
+	s.Engine.CommandCh <- util.Command{Action: "drop", Rect: *rect, Response: responseChan}
+	dropped := <-responseChan
+
+	slog.Info("Dropped features", "name", s.name, "count", dropped)
 	w.WriteHeader(http.StatusOK)
 }
 
-func parseRect(rectStr string) *[2][2]float64 {
-	rect := strings.Split(rectStr, ",")
-	if len(rect) < 4 {
-		return nil
+// redirectToLeader sends a write received by a follower to the leader. Only
+// the leader creates transactions, so the LSNs have a single writer.
+func (s *Storage) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	leader, _ := s.Leader()
+	if leader == "" {
+		http.Error(w, "Not a leader, no leader is elected yet", http.StatusServiceUnavailable)
+		return
 	}
 
-	minx, _ := strconv.ParseFloat(rect[0], 64)
-	miny, _ := strconv.ParseFloat(rect[1], 64)
-	maxx, _ := strconv.ParseFloat(rect[2], 64)
-	maxy, _ := strconv.ParseFloat(rect[3], 64)
+	target := "/" + leader + strings.TrimPrefix(r.URL.Path, "/"+s.name)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
 
-	return &[2][2]float64{{minx, miny}, {maxx, maxy}}
+	w.Header().Set("X-Leader", leader)
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
 }
@@ -1,11 +1,23 @@
 package util
 
-import "github.com/paulmach/orb/geojson"
+import (
+	"github.com/gorilla/websocket"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
 
 type Command struct {
 	Action      string `json:"action"`
 	Rect        [2][2]float64
+	Predicate   string           // Exact test of a select, none for bounding boxes
+	Geometry    orb.Geometry     // Query geometry of the predicate
+	Filter      *Filter          // Attribute filter of a select, nil for none
+	Nearest     Nearest          // Point, count and distance of a nearest search
 	Feature     *geojson.Feature `json:"feature"`
+	IfMatch     []string         // Versions a replace or delete expects
 	Response    chan<- any
 	Transaction Transaction
+	Snapshot    []Transaction
+	Addr        string
+	Conn        *websocket.Conn
 }
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+	"net/http"
+	"strings"
+)
+
+// Geometries are stored in CanonicalCRS, lon/lat on WGS84. Requests may use
+// web mercator instead: the proj parameter or the Content-Crs header tells
+// the CRS of the coordinates sent, the Accept-Crs header or else the proj
+// parameter the CRS of the coordinates returned.
+const (
+	CRS4326      = "EPSG:4326"
+	CRS3857      = "EPSG:3857"
+	CanonicalCRS = CRS4326
+)
+
+// ParseCRS returns the name of a supported CRS. An empty name is the
+// canonical CRS.
+func ParseCRS(name string) (string, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "", CRS4326, "OGC:CRS84", "URN:OGC:DEF:CRS:OGC:1.3:CRS84", "HTTP://WWW.OPENGIS.NET/DEF/CRS/OGC/1.3/CRS84":
+		return CRS4326, nil
+	case CRS3857, "EPSG:900913", "EPSG:102100":
+		return CRS3857, nil
+	}
+	return "", fmt.Errorf("unsupported CRS %q", name)
+}
+
+// RequestCRS returns the CRS of the coordinates sent in a request.
+func RequestCRS(r *http.Request) (string, error) {
+	if crs := r.URL.Query().Get("proj"); crs != "" {
+		return ParseCRS(crs)
+	}
+	return ParseCRS(r.Header.Get("Content-Crs"))
+}
+
+// ResponseCRS returns the CRS a request wants the coordinates returned in.
+func ResponseCRS(r *http.Request) (string, error) {
+	if crs := r.Header.Get("Accept-Crs"); crs != "" {
+		return ParseCRS(crs)
+	}
+	return ParseCRS(r.URL.Query().Get("proj"))
+}
+
+// ToCanonical reprojects a geometry from the CRS to the canonical CRS. The
+// geometry is changed in place.
+func ToCanonical(g orb.Geometry, crs string) orb.Geometry {
+	if crs != CRS3857 || g == nil {
+		return g
+	}
+	return project.Geometry(g, project.Mercator.ToWGS84)
+}
+
+// FromCanonical returns a copy of a canonical geometry in the CRS.
+func FromCanonical(g orb.Geometry, crs string) orb.Geometry {
+	if crs != CRS3857 || g == nil {
+		return g
+	}
+	return project.Geometry(orb.Clone(g), project.WGS84.ToMercator)
+}
+
+// RectToCanonical reprojects a rect from the CRS to the canonical CRS. Both
+// CRSs keep axis-parallel lines, so the corners are enough.
+func RectToCanonical(rect [2][2]float64, crs string) [2][2]float64 {
+	if crs != CRS3857 {
+		return rect
+	}
+	return [2][2]float64{project.Mercator.ToWGS84(rect[0]), project.Mercator.ToWGS84(rect[1])}
+}
+
+// ReprojectFeature returns the canonical feature with its geometry in the
+// CRS. The feature is not changed, a reprojected one is a copy.
+func ReprojectFeature(feature *geojson.Feature, crs string) *geojson.Feature {
+	if crs != CRS3857 {
+		return feature
+	}
+	projected := *feature
+	projected.Geometry = FromCanonical(feature.Geometry, crs)
+	return &projected
+}
@@ -0,0 +1,547 @@
+package util
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A filter is a subset of CQL2 text over the properties of a feature, like
+// category = 'cafe' AND rating >= 4. It has comparisons with = <> < <= > >=,
+// LIKE with % and _, IN, BETWEEN and IS NULL, joined by AND, OR, NOT and
+// parentheses. Properties are names or "quoted names", literals are 'strings'
+// with '' for a quote, numbers, TRUE and FALSE. Keywords are not case
+// sensitive.
+//
+// As in SQL, a comparison with a missing property, a null or a value of
+// another type is unknown, and a feature matches only if the filter is true.
+// NOT rating >= 4 leaves out features without a rating.
+
+// MaxFilterLength is the number of bytes of a filter expression.
+const MaxFilterLength = 4096
+
+// Filter is a parsed filter expression.
+type Filter struct {
+	expr expr
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(text string) (*Filter, error) {
+	if len(text) > MaxFilterLength {
+		return nil, fmt.Errorf("is longer than %d bytes", MaxFilterLength)
+	}
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+	return &Filter{expr: e}, nil
+}
+
+// Match reports whether the properties satisfy the filter. A nil filter
+// matches everything.
+func (f *Filter) Match(properties geojson.Properties) bool {
+	return f == nil || f.expr.eval(properties) == yes
+}
+
+// truth is the three-valued logic of SQL.
+type truth uint8
+
+const (
+	unknown truth = iota
+	no
+	yes
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return yes
+	}
+	return no
+}
+
+func (t truth) not() truth {
+	switch t {
+	case yes:
+		return no
+	case no:
+		return yes
+	}
+	return unknown
+}
+
+type expr interface {
+	eval(properties geojson.Properties) truth
+}
+
+type andExpr struct{ left, right expr }
+
+func (e andExpr) eval(properties geojson.Properties) truth {
+	left := e.left.eval(properties)
+	if left == no {
+		return no
+	}
+	right := e.right.eval(properties)
+	if right == no {
+		return no
+	}
+	if left == yes && right == yes {
+		return yes
+	}
+	return unknown
+}
+
+type orExpr struct{ left, right expr }
+
+func (e orExpr) eval(properties geojson.Properties) truth {
+	left := e.left.eval(properties)
+	if left == yes {
+		return yes
+	}
+	right := e.right.eval(properties)
+	if right == yes {
+		return yes
+	}
+	if left == no && right == no {
+		return no
+	}
+	return unknown
+}
+
+type notExpr struct{ expr expr }
+
+func (e notExpr) eval(properties geojson.Properties) truth {
+	return e.expr.eval(properties).not()
+}
+
+// operand is a property or a literal.
+type operand interface {
+	value(properties geojson.Properties) any
+}
+
+type property string
+
+func (p property) value(properties geojson.Properties) any {
+	return normalize(properties[string(p)])
+}
+
+type literal struct{ v any }
+
+func (l literal) value(geojson.Properties) any {
+	return l.v
+}
+
+// normalize turns the numbers of properties set in Go into float64, like the
+// ones decoded from JSON.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+	return v
+}
+
+// compare orders two values of the same type, false before true. Values of
+// different types cannot be compared.
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmp.Compare(a, b), true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmp.Compare(truthOf(a), truthOf(b)), true
+		}
+	}
+	return 0, false
+}
+
+type comparison struct {
+	op          string
+	left, right operand
+}
+
+func (c comparison) eval(properties geojson.Properties) truth {
+	order, ok := compare(c.left.value(properties), c.right.value(properties))
+	if !ok {
+		return unknown
+	}
+	switch c.op {
+	case "=":
+		return truthOf(order == 0)
+	case "<>":
+		return truthOf(order != 0)
+	case "<":
+		return truthOf(order < 0)
+	case "<=":
+		return truthOf(order <= 0)
+	case ">":
+		return truthOf(order > 0)
+	default:
+		return truthOf(order >= 0)
+	}
+}
+
+type likeExpr struct {
+	operand operand
+	pattern *regexp.Regexp
+}
+
+func (e likeExpr) eval(properties geojson.Properties) truth {
+	s, ok := e.operand.value(properties).(string)
+	if !ok {
+		return unknown
+	}
+	return truthOf(e.pattern.MatchString(s))
+}
+
+type inExpr struct {
+	operand operand
+	list    []operand
+}
+
+func (e inExpr) eval(properties geojson.Properties) truth {
+	result := no
+	for _, item := range e.list {
+		switch (comparison{op: "=", left: e.operand, right: item}).eval(properties) {
+		case yes:
+			return yes
+		case unknown:
+			result = unknown
+		}
+	}
+	return result
+}
+
+type isNullExpr struct{ operand operand }
+
+func (e isNullExpr) eval(properties geojson.Properties) truth {
+	return truthOf(e.operand.value(properties) == nil)
+}
+
+type tokenKind uint8
+
+const (
+	tokenEnd tokenKind = iota
+	tokenName
+	tokenKeyword
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string // Upper case for keywords
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEnd:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+var keywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "LIKE": true, "IN": true, "BETWEEN": true,
+	"IS": true, "NULL": true, "TRUE": true, "FALSE": true,
+}
+
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(text); {
+		start := i
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			// Strings and quoted names end at a single quote, a doubled one
+			// stands for itself
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i == len(text) {
+					return nil, fmt.Errorf("unterminated %c at %d", c, start)
+				}
+				if text[i] == c {
+					if i+1 == len(text) || text[i+1] != c {
+						i++
+						break
+					}
+					i++
+				}
+				sb.WriteByte(text[i])
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenName
+			}
+			tokens = append(tokens, token{kind: kind, text: sb.String(), pos: start})
+		case isDigit(c) || c == '.' || c == '-' || c == '+':
+			for i++; i < len(text) && (isDigit(text[i]) || text[i] == '.' || text[i] == 'e' || text[i] == 'E' ||
+				(text[i] == '-' || text[i] == '+') && (text[i-1] == 'e' || text[i-1] == 'E')); i++ {
+			}
+			if _, err := strconv.ParseFloat(text[start:i], 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", text[start:i], start)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text[start:i], pos: start})
+		case isNameStart(c):
+			for i++; i < len(text) && (isNameStart(text[i]) || isDigit(text[i])); i++ {
+			}
+			if word := strings.ToUpper(text[start:i]); keywords[word] {
+				tokens = append(tokens, token{kind: tokenKeyword, text: word, pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenName, text: text[start:i], pos: start})
+			}
+		default:
+			symbol := text[i : i+1]
+			if i+1 < len(text) {
+				switch text[i : i+2] {
+				case "<=", ">=", "<>", "!=":
+					symbol = text[i : i+2]
+				}
+			}
+			i += len(symbol)
+			switch symbol {
+			case "(", ")", ",", "=", "<", ">", "<=", ">=", "<>":
+			case "!=":
+				symbol = "<>"
+			default:
+				return nil, fmt.Errorf("unexpected %q at %d", symbol, start)
+			}
+			tokens = append(tokens, token{kind: tokenSymbol, text: symbol, pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(text)}), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isNameStart reports whether a name may start with the byte. Other names
+// are quoted.
+func isNameStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+// filterParser is a recursive descent parser, one method per precedence
+// level from OR down to a single comparison.
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or symbol.
+func (p *filterParser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokenKeyword || t.kind == tokenSymbol) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return fmt.Errorf("expected '%s' at %d, got %s", text, t.pos, t)
+	}
+	return nil
+}
+
+func (p *filterParser) or() (expr, error) {
+	left, err := p.and()
+	for err == nil && p.accept("OR") {
+		var right expr
+		if right, err = p.and(); err == nil {
+			left = orExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (expr, error) {
+	left, err := p.not()
+	for err == nil && p.accept("AND") {
+		var right expr
+		if right, err = p.not(); err == nil {
+			left = andExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) not() (expr, error) {
+	if p.accept("NOT") {
+		e, err := p.not()
+		return notExpr{e}, err
+	}
+	if p.accept("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	return p.predicate()
+}
+
+// predicate parses a comparison, LIKE, IN, BETWEEN or IS NULL.
+func (p *filterParser) predicate() (expr, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind == tokenSymbol && t.text != "(" && t.text != ")" && t.text != "," {
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{op: t.text, left: left, right: right}, nil
+	}
+
+	if p.accept("IS") {
+		negate := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		if negate {
+			return notExpr{isNullExpr{left}}, nil
+		}
+		return isNullExpr{left}, nil
+	}
+
+	negate := p.accept("NOT")
+	var e expr
+	switch {
+	case p.accept("LIKE"):
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, fmt.Errorf("expected a pattern at %d, got %s", t.pos, t)
+		}
+		e = likeExpr{operand: left, pattern: likePattern(t.text)}
+	case p.accept("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		in := inExpr{operand: left}
+		for {
+			item, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		e = in
+	case p.accept("BETWEEN"):
+		low, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		e = andExpr{comparison{op: ">=", left: left, right: low}, comparison{op: "<=", left: left, right: high}}
+	default:
+		t := p.peek()
+		return nil, fmt.Errorf("expected an operator at %d, got %s", t.pos, t)
+	}
+	if negate {
+		return notExpr{e}, nil
+	}
+	return e, nil
+}
+
+func (p *filterParser) operand() (operand, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenName:
+		return property(t.text), nil
+	case t.kind == tokenString:
+		return literal{t.text}, nil
+	case t.kind == tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return literal{f}, nil
+	case t.kind == tokenKeyword && (t.text == "TRUE" || t.text == "FALSE"):
+		return literal{t.text == "TRUE"}, nil
+	}
+	return nil, fmt.Errorf("expected a property or a value at %d, got %s", t.pos, t)
+}
+
+// likePattern turns a LIKE pattern into a regexp matching the whole string.
+// A backslash escapes the next character.
+func likePattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; {
+		case c == '%':
+			sb.WriteString(".*")
+		case c == '_':
+			sb.WriteString(".")
+		case c == '\\' && i+1 < len(runes):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
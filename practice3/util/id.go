@@ -0,0 +1,49 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NewID returns a random UUID for a feature which has no ID.
+func NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // Variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// ParseID returns the feature ID of a delete request: the id parameter, or
+// the ID of the feature in the body. The body may hold the ID alone.
+func ParseID(idStr string, body []byte) (any, error) {
+	if idStr != "" {
+		return idStr, nil
+	}
+
+	var feature struct {
+		ID any `json:"id"`
+	}
+	if err := json.Unmarshal(body, &feature); err != nil {
+		return nil, err
+	}
+	if feature.ID == nil || feature.ID == "" {
+		return nil, errors.New("missing feature ID")
+	}
+	return feature.ID, nil
+}
+
+// ParseETags returns the entity tags of an If-Match header without quotes.
+func ParseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag = strings.Trim(tag, `"`); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// Predicates relate the geometry of a feature to the query geometry of a
+// select.
+const (
+	Intersects = "intersects"
+	Within     = "within"
+	Contains   = "contains"
+	Disjoint   = "disjoint"
+)
+
+// Query is the spatial and attribute filter of a select. Without a
+// predicate it matches every feature whose bounding box overlaps the rect,
+// without a filter every feature whatever its properties.
+type Query struct {
+	Rect      [2][2]float64
+	Predicate string
+	Geometry  orb.Geometry
+	Filter    *Filter
+}
+
+// ParseQuery reads the rect, predicate, geometry and filter parameters of a
+// select and reprojects them from the proj parameter to the canonical CRS.
+// The geometry is GeoJSON and replaces the rect. A geometry without a predicate
+// is an intersects query, a predicate without a geometry applies to the
+// rect. The error of invalid parameters is a ValidationError.
+func ParseQuery(values url.Values) (*Query, error) {
+	v := &ValidationError{}
+	crs, err := ParseCRS(values.Get("proj"))
+	if err != nil {
+		v.Add("proj", "%v", err)
+	}
+	query := &Query{Predicate: values.Get("predicate")}
+	switch query.Predicate {
+	case "", Intersects, Within, Contains, Disjoint:
+	default:
+		v.Add("predicate", "must be one of %s, %s, %s or %s", Intersects, Within, Contains, Disjoint)
+	}
+	if filterStr := values.Get("filter"); filterStr != "" {
+		if query.Filter, err = ParseFilter(filterStr); err != nil {
+			v.Add("filter", "%v", err)
+		}
+	}
+
+	if geometryStr := values.Get("geometry"); geometryStr != "" {
+		geometry, err := geojson.UnmarshalGeometry([]byte(geometryStr))
+		switch {
+		case err != nil:
+			v.Add("geometry", "is not a GeoJSON geometry: %v", err)
+		case geometry.Coordinates == nil && len(geometry.Geometries) == 0:
+			v.Add("geometry", "is empty")
+		case len(v.Errors) == 0:
+			query.Geometry = ToCanonical(geometry.Geometry(), crs)
+			if err := ValidateGeometry("geometry", query.Geometry); err != nil {
+				v.Errors = append(v.Errors, err.(*ValidationError).Errors...)
+			}
+		}
+		if err := v.Err(); err != nil {
+			return nil, err
+		}
+
+		bound := query.Geometry.Bound()
+		query.Rect = [2][2]float64{bound.Min, bound.Max}
+		if query.Predicate == "" {
+			query.Predicate = Intersects
+		}
+		return query, nil
+	}
+
+	rect := ParseRect(values.Get("rect"))
+	if rect == nil {
+		v.Add("rect", "must be four numbers minx,miny,maxx,maxy with min not above max")
+	}
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+	query.Rect = RectToCanonical(*rect, crs)
+	if query.Predicate != "" {
+		query.Geometry = orb.Bound{Min: query.Rect[0], Max: query.Rect[1]}.ToPolygon()
+	}
+	return query, nil
+}
+
+// Limits of the k parameter of a nearest search.
+const (
+	DefaultNearest = 10
+	MaxNearest     = 1000
+)
+
+// Nearest is a search for the features nearest to a lon/lat point. A K of
+// zero is no limit, and a Meters of zero is no maximum distance.
+type Nearest struct {
+	Point  orb.Point
+	K      int
+	Meters float64
+}
+
+// ParseNearest reads the point, k and meters parameters of a nearest or
+// within-distance search. The point is reprojected from the proj parameter
+// to the canonical CRS. The error of invalid parameters is a
+// ValidationError.
+func ParseNearest(values url.Values) (*Nearest, error) {
+	v := &ValidationError{}
+	crs, err := ParseCRS(values.Get("proj"))
+	if err != nil {
+		v.Add("proj", "%v", err)
+	}
+
+	nearest := &Nearest{}
+	if point := ParsePoint(values.Get("point")); point == nil {
+		v.Add("point", "must be two numbers x,y")
+	} else if err == nil {
+		nearest.Point = ToCanonical(orb.Point(*point), crs).(orb.Point)
+		if p := nearest.Point; p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 {
+			v.Add("point", "is outside of the lon/lat range")
+		}
+	}
+
+	if kStr := values.Get("k"); kStr != "" {
+		k, err := strconv.Atoi(kStr)
+		if err != nil || k < 1 || k > MaxNearest {
+			v.Add("k", "must be a whole number from 1 to %d", MaxNearest)
+		}
+		nearest.K = k
+	}
+	if metersStr := values.Get("meters"); metersStr != "" {
+		meters, err := strconv.ParseFloat(metersStr, 64)
+		if err != nil || !(meters > 0) || math.IsInf(meters, 1) {
+			v.Add("meters", "must be a positive number")
+		}
+		nearest.Meters = meters
+	}
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+	return nearest, nil
+}
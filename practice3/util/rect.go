@@ -0,0 +1,71 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseRect parses "minx,miny,maxx,maxy" into a rect. It returns nil unless
+// there are four finite numbers with min not above max.
+func ParseRect(rectStr string) *[2][2]float64 {
+	rect := strings.Split(rectStr, ",")
+	if len(rect) != 4 {
+		return nil
+	}
+
+	var values [4]float64
+	for i, s := range rect {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+		values[i] = v
+	}
+	if values[0] > values[2] || values[1] > values[3] {
+		return nil
+	}
+
+	return &[2][2]float64{{values[0], values[1]}, {values[2], values[3]}}
+}
+
+// ParsePoint parses "x,y" into a point.
+func ParsePoint(pointStr string) *[2]float64 {
+	point := strings.Split(pointStr, ",")
+	if len(point) != 2 {
+		return nil
+	}
+
+	x, err := strconv.ParseFloat(point[0], 64)
+	if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil
+	}
+	y, err := strconv.ParseFloat(point[1], 64)
+	if err != nil || math.IsNaN(y) || math.IsInf(y, 0) {
+		return nil
+	}
+
+	return &[2]float64{x, y}
+}
+
+// ParseVClock parses "name:lsn,name:lsn" into a vclock.
+func ParseVClock(vclockStr string) (map[string]uint64, error) {
+	vclock := make(map[string]uint64)
+	if vclockStr == "" {
+		return vclock, nil
+	}
+
+	for _, entry := range strings.Split(vclockStr, ",") {
+		name, lsnStr, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid vclock entry %q", entry)
+		}
+		lsn, err := strconv.ParseUint(lsnStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LSN of %s: %w", name, err)
+		}
+		vclock[name] = lsn
+	}
+	return vclock, nil
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"github.com/paulmach/orb"
+)
+
+// Segment tests shared by the validation of rings and the predicates of a
+// select, so both agree on when segments meet.
+
+// Orient is positive if c lies left of the line through a and b, negative
+// if it lies right and zero if it lies on the line.
+func Orient(a, b, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// OnSegment reports whether p lies on the segment from a to b, ends
+// included.
+func OnSegment(p, a, b orb.Point) bool {
+	if Orient(a, b, p) != 0 {
+		return false
+	}
+	return min(a[0], b[0]) <= p[0] && p[0] <= max(a[0], b[0]) &&
+		min(a[1], b[1]) <= p[1] && p[1] <= max(a[1], b[1])
+}
+
+// Crossings returns the points where the segment ab meets the segment cd:
+// none, the one where they cross, or the ends of their overlap if they are
+// collinear.
+func Crossings(a, b, c, d orb.Point) []orb.Point {
+	d1, d2 := Orient(c, d, a), Orient(c, d, b)
+	d3, d4 := Orient(a, b, c), Orient(a, b, d)
+	if (d1 > 0 && d2 < 0 || d1 < 0 && d2 > 0) && (d3 > 0 && d4 < 0 || d3 < 0 && d4 > 0) {
+		t := d1 / (d1 - d2)
+		return []orb.Point{{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}}
+	}
+
+	var points []orb.Point
+	for _, p := range []struct{ p, s, e orb.Point }{{a, c, d}, {b, c, d}, {c, a, b}, {d, a, b}} {
+		if OnSegment(p.p, p.s, p.e) {
+			points = append(points, p.p)
+		}
+	}
+	return points
+}
+
+// SegmentsIntersect reports whether the segments ab and cd meet, at a
+// crossing, an end or an overlap.
+func SegmentsIntersect(a, b, c, d orb.Point) bool {
+	return len(Crossings(a, b, c, d)) > 0
+}
@@ -5,4 +5,10 @@ type Transaction struct {
 	Name    string      `json:"name"`
 	LSN     uint64      `json:"lsn"`
 	Feature interface{} `json:"feature"`
+	Time    int64       `json:"time,omitempty"` // Unix nanoseconds of the commit at its origin
+
+	// Leader election
+	Term    uint64            `json:"term,omitempty"`
+	Granted bool              `json:"granted,omitempty"`
+	VClock  map[string]uint64 `json:"vclock,omitempty"`
 }
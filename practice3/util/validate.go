@@ -0,0 +1,288 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Limits of a written feature.
+const (
+	MaxBodySize       = 8 << 20  // Bytes of a write request
+	MaxCoordinates    = 10000    // Positions of a geometry
+	MaxPropertiesSize = 64 << 10 // Bytes of the properties as JSON
+	MaxIDLength       = 256      // Bytes of a string ID
+)
+
+// FieldError is one invalid field of a request. Fields of a feature are
+// named by their path, like geometry.coordinates[0][2].
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists the invalid fields of a request. It is sent as the
+// body of a 400 response.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Field + " " + err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Add records an invalid field.
+func (e *ValidationError) Add(field string, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns the ValidationError if a field is invalid, nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// WriteBadRequest sends a ValidationError as a JSON document, and any other
+// error as text, with status 400.
+func WriteBadRequest(w http.ResponseWriter, err error) {
+	var v *ValidationError
+	if !errors.As(err, &v) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error  string       `json:"error"`
+		Errors []FieldError `json:"errors"`
+	}{"Invalid request", v.Errors})
+}
+
+// ValidateFeature checks a feature in the canonical CRS before it is
+// stored. With repair, unclosed rings are closed and rings are turned to
+// the winding order of RFC 7946, exterior rings counterclockwise and holes
+// clockwise. Otherwise the winding order is left as it is.
+func ValidateFeature(feature *geojson.Feature, repair bool) error {
+	v := &ValidationError{}
+
+	switch id := feature.ID.(type) {
+	case nil, float64:
+	case string:
+		if len(id) > MaxIDLength {
+			v.Add("id", "is longer than %d bytes", MaxIDLength)
+		}
+	default:
+		v.Add("id", "must be a string or a number")
+	}
+
+	if feature.Geometry == nil {
+		v.Add("geometry", "is required")
+	} else if n := countPositions(feature.Geometry); n > MaxCoordinates {
+		v.Add("geometry", "has %d positions, at most %d are allowed", n, MaxCoordinates)
+	} else {
+		feature.Geometry = validateGeometry(v, "geometry", feature.Geometry, repair)
+	}
+
+	if len(feature.Properties) > 0 {
+		data, err := json.Marshal(feature.Properties)
+		if err != nil {
+			v.Add("properties", "cannot be encoded: %v", err)
+		} else if len(data) > MaxPropertiesSize {
+			v.Add("properties", "are %d bytes, at most %d are allowed", len(data), MaxPropertiesSize)
+		}
+	}
+	return v.Err()
+}
+
+// ValidateGeometry checks a query geometry in the canonical CRS.
+func ValidateGeometry(field string, g orb.Geometry) error {
+	v := &ValidationError{}
+	if n := countPositions(g); n > MaxCoordinates {
+		v.Add(field, "has %d positions, at most %d are allowed", n, MaxCoordinates)
+		return v
+	}
+	validateGeometry(v, field, g, true)
+	return v.Err()
+}
+
+func countPositions(g orb.Geometry) int {
+	switch g := g.(type) {
+	case orb.Point:
+		return 1
+	case orb.MultiPoint:
+		return len(g)
+	case orb.LineString:
+		return len(g)
+	case orb.MultiLineString:
+		n := 0
+		for _, ls := range g {
+			n += len(ls)
+		}
+		return n
+	case orb.Ring:
+		return len(g)
+	case orb.Polygon:
+		n := 0
+		for _, ring := range g {
+			n += len(ring)
+		}
+		return n
+	case orb.MultiPolygon:
+		n := 0
+		for _, p := range g {
+			n += countPositions(p)
+		}
+		return n
+	case orb.Collection:
+		n := 0
+		for _, c := range g {
+			n += countPositions(c)
+		}
+		return n
+	}
+	return 0
+}
+
+// validateGeometry records the invalid parts of a geometry and returns the
+// geometry, repaired if asked to.
+func validateGeometry(v *ValidationError, field string, g orb.Geometry, repair bool) orb.Geometry {
+	coordinates := field + ".coordinates"
+	switch g := g.(type) {
+	case orb.Point:
+		validatePosition(v, coordinates, g)
+	case orb.MultiPoint:
+		for i, p := range g {
+			validatePosition(v, fmt.Sprintf("%s[%d]", coordinates, i), p)
+		}
+	case orb.LineString:
+		validateLine(v, coordinates, g)
+	case orb.MultiLineString:
+		for i, ls := range g {
+			validateLine(v, fmt.Sprintf("%s[%d]", coordinates, i), ls)
+		}
+	case orb.Polygon:
+		return validatePolygon(v, coordinates, g, repair)
+	case orb.MultiPolygon:
+		for i, p := range g {
+			g[i] = validatePolygon(v, fmt.Sprintf("%s[%d]", coordinates, i), p, repair)
+		}
+	case orb.Collection:
+		for i, c := range g {
+			g[i] = validateGeometry(v, fmt.Sprintf("%s.geometries[%d]", field, i), c, repair)
+		}
+	default:
+		v.Add(field, "has an unsupported type %s", g.GeoJSONType())
+	}
+	return g
+}
+
+func validatePosition(v *ValidationError, field string, p orb.Point) {
+	switch {
+	case math.IsNaN(p[0]) || math.IsNaN(p[1]) || math.IsInf(p[0], 0) || math.IsInf(p[1], 0):
+		v.Add(field, "is not a finite position")
+	case p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90:
+		v.Add(field, "is outside of the lon/lat range")
+	}
+}
+
+func validateLine(v *ValidationError, field string, ls orb.LineString) {
+	if len(ls) < 2 {
+		v.Add(field, "needs at least 2 positions")
+	}
+	for i, p := range ls {
+		validatePosition(v, fmt.Sprintf("%s[%d]", field, i), p)
+	}
+}
+
+func validatePolygon(v *ValidationError, field string, polygon orb.Polygon, repair bool) orb.Polygon {
+	if len(polygon) == 0 {
+		v.Add(field, "needs an exterior ring")
+	}
+	for i, ring := range polygon {
+		polygon[i] = validateRing(v, fmt.Sprintf("%s[%d]", field, i), ring, i > 0, repair)
+	}
+	return polygon
+}
+
+// validateRing checks that a ring is closed, has at least 4 positions and
+// does not cross or touch itself.
+func validateRing(v *ValidationError, field string, ring orb.Ring, hole bool, repair bool) orb.Ring {
+	valid := len(v.Errors)
+	for i, p := range ring {
+		validatePosition(v, fmt.Sprintf("%s[%d]", field, i), p)
+	}
+	if len(v.Errors) > valid {
+		return ring
+	}
+
+	if len(ring) > 0 && !ring.Closed() {
+		if !repair {
+			v.Add(field, "is not closed, the last position must equal the first")
+			return ring
+		}
+		ring = append(ring, ring[0])
+	}
+	if len(ring) < 4 {
+		v.Add(field, "needs at least 4 positions")
+		return ring
+	}
+	if i, j, ok := selfIntersection(ring); ok {
+		v.Add(field, "intersects itself between segments %d and %d", i, j)
+		return ring
+	}
+
+	if repair && (ring.Orientation() == orb.CCW) == hole {
+		ring.Reverse()
+	}
+	return ring
+}
+
+// selfIntersection returns the first segments of a closed ring which meet,
+// other than neighbours at their shared position.
+func selfIntersection(ring orb.Ring) (int, int, bool) {
+	n := len(ring) - 1
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			// Neighbours share a position, they only meet elsewhere if they
+			// fold back onto each other
+			if j == i+1 {
+				if foldsBack(ring[i], ring[j], ring[j+1]) {
+					return i, j, true
+				}
+				continue
+			}
+			if i == 0 && j == n-1 {
+				if foldsBack(ring[j], ring[0], ring[1]) {
+					return i, j, true
+				}
+				continue
+			}
+			if SegmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// foldsBack reports whether the segments from a to shared and from shared
+// to c overlap.
+func foldsBack(a, shared, c orb.Point) bool {
+	if a == shared || c == shared || Orient(a, shared, c) != 0 {
+		return false
+	}
+	return OnSegment(c, a, shared) || OnSegment(a, shared, c)
+}